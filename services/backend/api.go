@@ -0,0 +1,270 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/billing"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+type sessionQuerier interface {
+	currentSession(garage, vehiclePlate string) (session, bool, error)
+	sessionHistory(garage, vehiclePlate string) ([]session, error)
+	listSessions(garage string, state sessionState, since time.Time, offset, limit int) ([]session, error)
+	openSessionCount(garage string) (int64, error)
+	orphanedSessionCount(garage string) (int64, error)
+}
+
+// Read-only query API for operators, served from the same Redis data the consumers write. Every
+// endpoint answers for the garage in the garage query parameter, the default garage without one.
+type queryAPI struct {
+	database sessionQuerier
+	tariff   *billing.Tariff
+	// Capacity of each garage, zero when it is unknown
+	capacities garageCapacities
+	now        func() time.Time
+}
+
+// Capacities by garage id, with a fallback for garages not listed
+type garageCapacities struct {
+	byGarage map[string]int
+	fallback int
+}
+
+func (c garageCapacities) of(garage string) int {
+	if capacity, ok := c.byGarage[garage]; ok {
+		return capacity
+	}
+	return c.fallback
+}
+
+// parseCapacities reads capacities in the form "north=120,south=80"
+func parseCapacities(value string, fallback int) (garageCapacities, error) {
+	capacities := garageCapacities{byGarage: map[string]int{}, fallback: fallback}
+	if value == "" {
+		return capacities, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		garage, capacity, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		parsed, err := strconv.Atoi(capacity)
+		if !ok || garage == "" || err != nil || parsed < 0 {
+			return capacities, fmt.Errorf("expected <garage>=<capacity>, got %q", pair)
+		}
+		capacities.byGarage[garage] = parsed
+	}
+	return capacities, nil
+}
+
+type plateSessionsResponse struct {
+	GarageId     string    `json:"garage_id"`
+	VehiclePlate string    `json:"vehicle_plate"`
+	Current      *session  `json:"current"`
+	History      []session `json:"history"`
+}
+
+type occupancyResponse struct {
+	GarageId string `json:"garage_id"`
+	Occupied int64  `json:"occupied"`
+	Orphaned int64  `json:"orphaned"`
+	Capacity int    `json:"capacity,omitempty"`
+}
+
+type sessionPageResponse struct {
+	Sessions   []session `json:"sessions"`
+	NextOffset *int      `json:"next_offset,omitempty"`
+}
+
+type feeEstimateResponse struct {
+	GarageId        string `json:"garage_id"`
+	VehiclePlate    string `json:"vehicle_plate"`
+	SessionId       string `json:"session_id"`
+	EntryDateTime   string `json:"entry_date_time"`
+	AsOf            string `json:"as_of"`
+	DurationSeconds int64  `json:"duration_seconds"`
+	Fee             int64  `json:"fee"`
+	Currency        string `json:"currency"`
+	TariffVersion   string `json:"tariff_version"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (a *queryAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /sessions/{plate}", a.getPlateSessions)
+	mux.HandleFunc("GET /sessions", a.listSessions)
+	mux.HandleFunc("GET /occupancy", a.getOccupancy)
+	mux.HandleFunc("GET /fee-estimate/{plate}", a.getFeeEstimate)
+	mux.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPIDocument)
+	})
+}
+
+// requestedGarage returns the garage the request asks about
+func requestedGarage(r *http.Request) string {
+	return garageOrDefault(r.URL.Query().Get("garage"))
+}
+
+func (a *queryAPI) getPlateSessions(w http.ResponseWriter, r *http.Request) {
+	plate := r.PathValue("plate")
+	garage := requestedGarage(r)
+	response := plateSessionsResponse{GarageId: garage, VehiclePlate: plate}
+
+	current, ok, err := a.database.currentSession(garage, plate)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if ok {
+		response.Current = &current
+	}
+
+	response.History, err = a.database.sessionHistory(garage, plate)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (a *queryAPI) listSessions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	state := sessionState(query.Get("state"))
+	switch state {
+	case "", "open", sessionOpen:
+		state = sessionOpen
+	case "orphaned", sessionOrphaned:
+		state = sessionOrphaned
+	default:
+		writeError(w, http.StatusBadRequest, "state must be open or orphaned")
+		return
+	}
+
+	since := time.Time{}
+	if value := query.Get("since"); value != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+			return
+		}
+	}
+
+	offset, ok := queryInt(w, query.Get("offset"), 0, "offset")
+	if !ok {
+		return
+	}
+	limit, ok := queryInt(w, query.Get("limit"), defaultPageSize, "limit")
+	if !ok {
+		return
+	}
+	limit = min(max(limit, 1), maxPageSize)
+
+	// Ask for one extra session to find out whether there is a next page
+	sessions, err := a.database.listSessions(requestedGarage(r), state, since, offset, limit+1)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	response := sessionPageResponse{Sessions: sessions}
+	if len(sessions) > limit {
+		response.Sessions = sessions[:limit]
+		next := offset + limit
+		response.NextOffset = &next
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (a *queryAPI) getOccupancy(w http.ResponseWriter, r *http.Request) {
+	garage := requestedGarage(r)
+	occupied, err := a.database.openSessionCount(garage)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	orphaned, err := a.database.orphanedSessionCount(garage)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, occupancyResponse{GarageId: garage, Occupied: occupied, Orphaned: orphaned, Capacity: a.capacities.of(garage)})
+}
+
+func (a *queryAPI) getFeeEstimate(w http.ResponseWriter, r *http.Request) {
+	plate := r.PathValue("plate")
+	garage := requestedGarage(r)
+	current, ok, err := a.database.currentSession(garage, plate)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "no open session for "+plate+" in garage "+garage)
+		return
+	}
+
+	entryTime, err := parseEventTime(current.EntryDateTime)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	now := a.now().UTC()
+	fee, err := a.tariff.Fee(entryTime, now)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, feeEstimateResponse{
+		GarageId:        garage,
+		VehiclePlate:    plate,
+		SessionId:       current.Id,
+		EntryDateTime:   current.EntryDateTime,
+		AsOf:            now.Format(time.RFC3339Nano),
+		DurationSeconds: int64(now.Sub(entryTime).Seconds()),
+		Fee:             fee,
+		Currency:        a.tariff.Currency,
+		TariffVersion:   a.tariff.Version,
+	})
+}
+
+func queryInt(w http.ResponseWriter, value string, def int, name string) (int, bool) {
+	if value == "" {
+		return def, true
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		writeError(w, http.StatusBadRequest, name+" must be a non-negative integer")
+		return 0, false
+	}
+	return parsed, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Println("Failed to write response: ", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{message})
+}
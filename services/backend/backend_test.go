@@ -1,48 +1,1147 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"backend/billing"
+	"health"
 )
 
+// Plate within a garage, the same plate in two garages has two sessions
+type garagePlate struct {
+	garage string
+	plate  string
+}
+
+// Sessions, open plates and held exits by garage like the Redis keys
 type mapDatabase struct {
-	storage map[string]entryEvent
+	sessions  map[string]session
+	open      map[garagePlate]string
+	processed map[string]bool
+	held      map[string]heldExit
+}
+
+func newMapDatabase(sessions ...session) *mapDatabase {
+	m := &mapDatabase{sessions: map[string]session{}, open: map[garagePlate]string{}, processed: map[string]bool{}, held: map[string]heldExit{}}
+	for _, s := range sessions {
+		s.GarageId = garageOrDefault(s.GarageId)
+		m.sessions[s.Id] = s
+		if s.State == sessionOpen {
+			m.open[garagePlate{s.GarageId, s.VehiclePlate}] = s.Id
+		}
+	}
+	return m
+}
+
+func (m *mapDatabase) openSession(ctx context.Context, entryEvent entryEvent, entryTime time.Time) (session, error) {
+	key := garagePlate{entryEvent.GarageId, entryEvent.VehiclePlate}
+	if existing, ok := m.sessions[entryEvent.Id]; ok {
+		return existing, nil
+	}
+	if previous, ok := m.open[key]; ok {
+		disputed := m.sessions[previous]
+		disputed.State = sessionDisputed
+		m.sessions[previous] = disputed
+	}
+	s := session{
+		Id:            entryEvent.Id,
+		VehiclePlate:  entryEvent.VehiclePlate,
+		State:         sessionOpen,
+		EntryEventId:  entryEvent.Id,
+		EntryDateTime: entryEvent.EntryDateTime,
+		GarageId:      entryEvent.GarageId,
+		EntryGateId:   entryEvent.GateId,
+		EntryLaneId:   entryEvent.LaneId,
+	}
+	m.sessions[s.Id] = s
+	m.open[key] = s.Id
+	return s, nil
 }
 
-func (m *mapDatabase) store(entryEvent entryEvent) {
-	m.storage[entryEvent.VehiclePlate] = entryEvent
+func (m *mapDatabase) closeSession(ctx context.Context, vehiclePlate string, exitEvent exitEvent) (session, bool, error) {
+	key := garagePlate{exitEvent.GarageId, vehiclePlate}
+	id, ok := m.open[key]
+	if !ok {
+		return session{}, false, nil
+	}
+	s := m.sessions[id]
+	s.State = sessionClosed
+	s.ExitEventId = exitEvent.Id
+	s.ExitDateTime = exitEvent.ExitDateTime
+	s.ExitGateId = exitEvent.GateId
+	s.ExitLaneId = exitEvent.LaneId
+	m.sessions[id] = s
+	delete(m.open, key)
+	return s, true, nil
+}
+
+func (m *mapDatabase) openSessionPlates(ctx context.Context, garage string) ([]string, error) {
+	plates := []string{}
+	for key := range m.open {
+		if key.garage == garage {
+			plates = append(plates, key.plate)
+		}
+	}
+	return plates, nil
 }
 
-func (m *mapDatabase) get(vehiclePlate string) (entryEvent, bool) {
-	entryEvent, ok := m.storage[vehiclePlate]
-	return entryEvent, ok
+func (m *mapDatabase) claimEvent(ctx context.Context, kind, id string) (bool, error) {
+	if m.processed[kind+":"+id] {
+		return false, nil
+	}
+	m.processed[kind+":"+id] = true
+	return true, nil
 }
 
-type mockHTTPClient struct{}
+func (m *mapDatabase) releaseEvent(ctx context.Context, kind, id string) error {
+	delete(m.processed, kind+":"+id)
+	return nil
+}
+
+func (m *mapDatabase) holdExit(held heldExit, deadline time.Time) error {
+	held.key = heldExitKey(held.Exit.GarageId, held.Exit.Id)
+	m.held[held.key] = held
+	return nil
+}
+
+func (m *mapDatabase) heldExitsFor(garage, vehiclePlate string) ([]heldExit, error) {
+	exits := []heldExit{}
+	for _, held := range m.held {
+		if held.Exit.GarageId == garage && held.Exit.VehiclePlate == vehiclePlate {
+			exits = append(exits, held)
+		}
+	}
+	sort.Slice(exits, func(i, j int) bool { return exits[i].HeldAt.Before(exits[j].HeldAt) })
+	return exits, nil
+}
+
+func (m *mapDatabase) removeHeldExit(held heldExit) error {
+	delete(m.held, held.key)
+	return nil
+}
+
+func (m *mapDatabase) claimExpiredHeldExits(now time.Time) ([]heldExit, error) {
+	return nil, nil
+}
+
+func (m *mapDatabase) unclaimHeldExit(held heldExit, deadline time.Time) error {
+	return nil
+}
+
+func (m *mapDatabase) currentSession(garage, vehiclePlate string) (session, bool, error) {
+	id, ok := m.open[garagePlate{garage, vehiclePlate}]
+	return m.sessions[id], ok, nil
+}
+
+func (m *mapDatabase) sessionHistory(garage, vehiclePlate string) ([]session, error) {
+	history := []session{}
+	for _, s := range m.sessions {
+		if s.GarageId == garage && s.VehiclePlate == vehiclePlate {
+			history = append(history, s)
+		}
+	}
+	return history, nil
+}
+
+func (m *mapDatabase) listSessions(garage string, state sessionState, since time.Time, offset, limit int) ([]session, error) {
+	sessions := []session{}
+	for _, s := range m.sessions {
+		if s.GarageId == garage && s.State == state {
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Id < sessions[j].Id })
+	sessions = sessions[min(offset, len(sessions)):]
+	return sessions[:min(limit, len(sessions))], nil
+}
+
+func (m *mapDatabase) openSessionCount(garage string) (int64, error) {
+	plates, _ := m.openSessionPlates(context.Background(), garage)
+	return int64(len(plates)), nil
+}
+
+func (m *mapDatabase) orphanedSessionCount(garage string) (int64, error) {
+	return 0, nil
+}
+
+type mockHTTPClient struct {
+	summaries    []billing.Summary
+	traceparents []string
+}
 
 func (m *mockHTTPClient) Do(req *http.Request) (*http.Response, error) {
-	return &http.Response{StatusCode: 200}, nil
+	if req.Header.Get("Idempotency-Key") == "" {
+		return &http.Response{StatusCode: http.StatusBadRequest, Body: http.NoBody}, nil
+	}
+	if req.Body != nil {
+		summary := billing.Summary{}
+		json.NewDecoder(req.Body).Decode(&summary)
+		m.summaries = append(m.summaries, summary)
+		m.traceparents = append(m.traceparents, req.Header.Get("traceparent"))
+	}
+	return &http.Response{StatusCode: 200, Body: http.NoBody}, nil
+}
+
+type mockAcknowledger struct {
+	acked, nacked, requeued bool
+}
+
+func (m *mockAcknowledger) Ack(tag uint64, multiple bool) error {
+	m.acked = true
+	return nil
+}
+
+func (m *mockAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	m.nacked = true
+	m.requeued = requeue
+	return nil
+}
+
+func (m *mockAcknowledger) Reject(tag uint64, requeue bool) error {
+	return m.Nack(tag, false, requeue)
+}
+
+type publishedMessage struct {
+	exchange, key string
+	msg           amqp.Publishing
+}
+
+type mockPublisher struct {
+	published []publishedMessage
+	// Returned instead of publishing, as when the broker does not confirm the message
+	err error
+}
+
+func (m *mockPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.published = append(m.published, publishedMessage{exchange, key, msg})
+	return nil
 }
 
 func TestEntryEventFunc(t *testing.T) {
-	database := &mapDatabase{storage: map[string]entryEvent{}}
+	database := newMapDatabase()
 	body := []byte(`{"id":"1","vehicle_plate":"ABC123","entry_date_time":"2021-01-01T00:00:00Z"}`)
 	entryQ := amqp.Delivery{Body: body}
 
-	entryEventFunc(entryQ, database)
+	entryEventFunc(entryQ, database, nil)
 
-	if _, ok := database.get("ABC123"); !ok {
-		t.Errorf("Failed to store entry event")
+	if _, ok := database.open[garagePlate{defaultGarage, "ABC123"}]; !ok {
+		t.Errorf("Failed to open a session for the entry event")
+	}
+}
+
+func TestEntryRedeliveredAfterExit(t *testing.T) {
+	database := newMapDatabase()
+	entry := amqp.Delivery{Body: []byte(`{"id":"1","vehicle_plate":"ABC123","entry_date_time":"2021-01-01T00:00:00Z"}`)}
+	exit := amqp.Delivery{Body: []byte(`{"id":"2","vehicle_plate":"ABC123","exit_date_time":"2021-01-01T02:00:00Z"}`)}
+
+	entryEventFunc(entry, database, nil)
+	if err := exitEventFunc(exit, database, testTariff(t), testMatcher(&mockPublisher{}), nil, testSinks(&mockHTTPClient{})); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The claim expired or was lost, the session itself must not open again
+	delete(database.processed, "entry:1")
+	entryEventFunc(entry, database, nil)
+
+	if database.sessions["1"].State != sessionClosed {
+		t.Errorf("Expected the redelivered entry to leave the closed session alone, got %s", database.sessions["1"].State)
+	}
+	if _, ok := database.open[garagePlate{defaultGarage, "ABC123"}]; ok {
+		t.Errorf("Expected no open session after the redelivered entry")
 	}
 }
 
 func TestExitEventFunc(t *testing.T) {
-	database := &mapDatabase{storage: map[string]entryEvent{"ABC123": {Id: "1", VehiclePlate: "ABC123", EntryDateTime: "2021-01-01T00:00:00Z"}}}
+	database := newMapDatabase(session{Id: "1", VehiclePlate: "ABC123", State: sessionOpen, EntryEventId: "1", EntryDateTime: "2021-01-01T00:00:00Z"})
 	body := []byte(`{"id":"1","vehicle_plate":"ABC123","exit_date_time":"2021-01-01T00:00:00Z"}`)
 	exitQ := amqp.Delivery{Body: body}
 	httpClient := &mockHTTPClient{}
 
-	exitEventFunc(exitQ, database, httpClient, "")
+	if err := exitEventFunc(exitQ, database, testTariff(t), testMatcher(&mockPublisher{}), nil, testSinks(httpClient)); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if database.sessions["1"].State != sessionClosed {
+		t.Errorf("Expected the session to be closed")
+	}
+}
+
+func TestExitEventFuncDuplicate(t *testing.T) {
+	database := newMapDatabase(session{Id: "1", VehiclePlate: "ABC123", State: sessionOpen, EntryEventId: "1", EntryDateTime: "2021-01-01T00:00:00Z"})
+	body := []byte(`{"id":"2","vehicle_plate":"ABC123","exit_date_time":"2021-01-01T02:00:00Z"}`)
+	httpClient := &mockHTTPClient{}
+	before := counterValue(t, duplicateEvents.WithLabelValues("exit", defaultGarage, ""))
+
+	for i := 0; i < 2; i++ {
+		if err := exitEventFunc(amqp.Delivery{Body: body}, database, testTariff(t), testMatcher(&mockPublisher{}), nil, testSinks(httpClient)); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	if len(httpClient.summaries) != 1 {
+		t.Errorf("Expected a single summary for a duplicated exit, got %d", len(httpClient.summaries))
+	}
+	if counterValue(t, duplicateEvents.WithLabelValues("exit", defaultGarage, ""))-before != 1 {
+		t.Errorf("Expected the duplicate to be counted")
+	}
+}
+
+func TestExitEventFuncReleasesClaim(t *testing.T) {
+	database := newMapDatabase(session{Id: "1", VehiclePlate: "ABC123", State: sessionOpen, EntryEventId: "1", EntryDateTime: "2021-01-01T00:00:00Z"})
+	body := []byte(`{"id":"2","vehicle_plate":"ABC123","exit_date_time":"2021-01-01T02:00:00Z"}`)
+	sinks := directQueue{&failingSink{err: errors.New("sink down")}}
+
+	if err := exitEventFunc(amqp.Delivery{Body: body}, database, testTariff(t), testMatcher(&mockPublisher{}), nil, sinks); err == nil {
+		t.Fatalf("Expected the sink error")
+	}
+	if database.processed["exit:2"] {
+		t.Errorf("Expected the failed exit to give up its claim so the retry is processed")
+	}
+}
+
+func TestExitBeforeEntry(t *testing.T) {
+	database := newMapDatabase()
+	publisher := &mockPublisher{}
+	holder := &exitHolder{database: database, publisher: publisher, window: time.Minute}
+	httpClient := &mockHTTPClient{}
+	exitBody := []byte(`{"id":"2","vehicle_plate":"ABC123","exit_date_time":"2021-01-01T02:00:00Z"}`)
+
+	if err := exitEventFunc(amqp.Delivery{Body: exitBody}, database, testTariff(t), testMatcher(publisher), holder, testSinks(httpClient)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := database.held[heldExitKey(defaultGarage, "2")]; !ok || len(httpClient.summaries) != 0 {
+		t.Fatalf("Expected the unmatched exit to be held without a summary")
+	}
+
+	entryBody := []byte(`{"id":"1","vehicle_plate":"ABC123","entry_date_time":"2021-01-01T00:00:00Z"}`)
+	if err := entryEventFunc(amqp.Delivery{Body: entryBody}, database, holder); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(publisher.published) != 1 || publisher.published[0].key != exitQueueName {
+		t.Fatalf("Expected the held exit to be requeued once its entry arrived, got %+v", publisher.published)
+	}
+
+	requeued := publisher.published[0].msg
+	d := amqp.Delivery{Headers: requeued.Headers, Body: requeued.Body}
+	if err := exitEventFunc(d, database, testTariff(t), testMatcher(publisher), holder, testSinks(httpClient)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(httpClient.summaries) != 1 || httpClient.summaries[0].MatchType != string(matchExact) {
+		t.Errorf("Expected the requeued exit to match its entry, got %+v", httpClient.summaries)
+	}
+
+	// Once the window has passed the exit is billed as unmatched
+	if holder.shouldHold(time.Now().Add(-2*time.Minute), time.Now()) {
+		t.Errorf("Expected no further hold after the window")
+	}
+}
+
+func TestHeldExitsOfOnePlate(t *testing.T) {
+	database := newMapDatabase(session{Id: "9", VehiclePlate: "ABC124", State: sessionOpen, EntryEventId: "9", EntryDateTime: "2021-01-01T00:00:00Z"})
+	publisher := &mockPublisher{}
+	holder := &exitHolder{database: database, publisher: publisher, window: time.Minute}
+	httpClient := &mockHTTPClient{}
+	held := counterValue(t, exitsHeld.WithLabelValues(defaultGarage))
+	unmatched := counterValue(t, eventOutcomes.WithLabelValues("exit", outcomeUnmatched, defaultGarage, ""))
+
+	// ABC124 is one edit away, fuzzy matching has to wait for the hold
+	for _, id := range []string{"2", "3"} {
+		body := []byte(`{"id":"` + id + `","vehicle_plate":"ABC123","exit_date_time":"2021-01-01T02:00:00Z"}`)
+		if err := exitEventFunc(amqp.Delivery{Body: body}, database, testTariff(t), testMatcher(publisher), holder, testSinks(httpClient)); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if len(database.held) != 2 || len(httpClient.summaries) != 0 || database.sessions["9"].State != sessionOpen {
+		t.Fatalf("Expected both exits held and no fuzzy match, got %d held, %+v", len(database.held), httpClient.summaries)
+	}
+	// Counted as held only, their outcome is counted once they come back
+	if counterValue(t, exitsHeld.WithLabelValues(defaultGarage))-held != 2 ||
+		counterValue(t, eventOutcomes.WithLabelValues("exit", outcomeUnmatched, defaultGarage, ""))-unmatched != 0 {
+		t.Errorf("Expected the held exits in exits_held_total and not in events_processed_total")
+	}
+
+	if err := holder.releaseFor(defaultGarage, "ABC123"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(publisher.published) != 2 || len(database.held) != 0 {
+		t.Errorf("Expected both held exits requeued, got %d published and %d still held", len(publisher.published), len(database.held))
+	}
+}
+
+func TestParseEventTime(t *testing.T) {
+	expected := time.Date(2024, 1, 1, 10, 0, 0, 123000000, time.UTC)
+	for _, value := range []string{
+		"2024-01-01T10:00:00.123Z",
+		"2024-01-01T12:00:00.123+02:00",
+		"2024-01-01 10:00:00.123 +0000 UTC",
+		"2024-01-01 10:00:00.123 +0000 UTC m=+12.3",
+	} {
+		parsed, err := parseEventTime(value)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", value, err)
+		} else if !parsed.Equal(expected) || parsed.Location() != time.UTC {
+			t.Errorf("Expected %s from %q, got %s", expected, value, parsed)
+		}
+	}
+
+	acceptLegacyTimestamps = false
+	defer func() { acceptLegacyTimestamps = true }()
+	if _, err := parseEventTime("2024-01-01 10:00:00.123 +0000 UTC"); err == nil {
+		t.Errorf("Expected the legacy format to be rejected once disabled")
+	}
+	if _, err := parseEventTime("yesterday"); err == nil {
+		t.Errorf("Expected garbage to be rejected")
+	}
+}
+
+func TestExitBeforeEntryAnomaly(t *testing.T) {
+	database := newMapDatabase(session{Id: "1", VehiclePlate: "ABC123", State: sessionOpen, EntryEventId: "1", EntryDateTime: "2021-01-01T02:00:00Z"})
+	body := []byte(`{"id":"2","vehicle_plate":"ABC123","exit_date_time":"2021-01-01T01:00:00Z"}`)
+	httpClient := &mockHTTPClient{}
+
+	err := exitEventFunc(amqp.Delivery{Body: body}, database, testTariff(t), testMatcher(&mockPublisher{}), nil, testSinks(httpClient))
+	var permanent permanentError
+	if !errors.As(err, &permanent) {
+		t.Fatalf("Expected a permanent error for an exit before its entry, got %v", err)
+	}
+	// Left open, a replay from the dead-letter queue finds it as it was
+	if database.sessions["1"].State != sessionOpen || len(httpClient.summaries) != 0 {
+		t.Errorf("Expected the session to stay open without a summary, got %s", database.sessions["1"].State)
+	}
+}
+
+func TestHandleDeliveryMalformed(t *testing.T) {
+	database := newMapDatabase()
+	acknowledger := &mockAcknowledger{}
+	publisher := &mockPublisher{}
+	d := amqp.Delivery{Acknowledger: acknowledger, RoutingKey: entryQueueName, Body: []byte(`not json`)}
+
+	handleDelivery(d, func(d amqp.Delivery) error { return entryEventFunc(d, database, nil) }, publisher, testRetry(5))
+
+	if !acknowledger.acked {
+		t.Errorf("Expected malformed message to be acked after dead-lettering")
+	}
+	if len(publisher.published) != 1 || publisher.published[0].exchange != deadLetterExchange {
+		t.Fatalf("Expected message to be published to the dead-letter exchange, got %+v", publisher.published)
+	}
+	if reason, _ := publisher.published[0].msg.Headers[failureReasonHeader].(string); reason == "" {
+		t.Errorf("Expected failure reason header to be set")
+	}
+}
+
+func TestHandleDeliveryRetry(t *testing.T) {
+	acknowledger := &mockAcknowledger{}
+	publisher := &mockPublisher{}
+	d := amqp.Delivery{Acknowledger: acknowledger, RoutingKey: exitQueueName, Body: []byte(`{}`)}
+	failing := func(d amqp.Delivery) error { return errors.New("redis unavailable") }
+
+	handleDelivery(d, failing, publisher, testRetry(3))
+
+	if len(publisher.published) != 1 || publisher.published[0].exchange != "" || publisher.published[0].key != exitQueueName+retryQueueAffix {
+		t.Fatalf("Expected message to be published to its retry queue, got %+v", publisher.published)
+	}
+	retried := publisher.published[0].msg
+	if retried.Headers[retryCountHeader] != int32(1) {
+		t.Errorf("Expected retry count 1, got %v", retried.Headers[retryCountHeader])
+	}
+	if ttl, _ := strconv.Atoi(retried.Expiration); ttl < 500 || ttl > 1000 {
+		t.Errorf("Expected the first retry to wait 0.5-1s, got expiration %q", retried.Expiration)
+	}
+	if !acknowledger.acked {
+		t.Errorf("Expected the original to be acked once the retry was published")
+	}
+
+	// The broker dead-letters the expired retry back onto the event queue, the delay grows
+	d = amqp.Delivery{Acknowledger: acknowledger, RoutingKey: exitQueueName, Headers: retried.Headers, Body: retried.Body}
+	handleDelivery(d, failing, publisher, testRetry(3))
+
+	retried = publisher.published[1].msg
+	if ttl, _ := strconv.Atoi(retried.Expiration); ttl < 1000 || ttl > 2000 {
+		t.Errorf("Expected the second retry to wait 1-2s, got expiration %q", retried.Expiration)
+	}
+
+	// The third failure reaches the cap
+	d = amqp.Delivery{Acknowledger: acknowledger, RoutingKey: exitQueueName, Headers: retried.Headers, Body: retried.Body}
+	handleDelivery(d, failing, publisher, testRetry(3))
+
+	if len(publisher.published) != 3 || publisher.published[2].exchange != deadLetterExchange {
+		t.Fatalf("Expected message to be dead-lettered once the retry cap is reached, got %+v", publisher.published)
+	}
+	if publisher.published[2].msg.Expiration != "" {
+		t.Errorf("Expected the dead-lettered message not to expire, got %q", publisher.published[2].msg.Expiration)
+	}
+}
+
+func TestHandleDeliveryRetryUnconfirmed(t *testing.T) {
+	acknowledger := &mockAcknowledger{}
+	publisher := &mockPublisher{err: errors.New("broker nacked the message")}
+	d := amqp.Delivery{Acknowledger: acknowledger, RoutingKey: exitQueueName, Body: []byte(`{}`)}
+	failing := func(d amqp.Delivery) error { return errors.New("redis unavailable") }
+
+	handleDelivery(d, failing, publisher, testRetry(3))
+
+	if acknowledger.acked {
+		t.Errorf("Expected the original not to be acked without a confirmed retry")
+	}
+	if !acknowledger.nacked || !acknowledger.requeued {
+		t.Errorf("Expected the original to be requeued, got nacked=%v requeued=%v", acknowledger.nacked, acknowledger.requeued)
+	}
+}
+
+func testRetry(maxAttempts int) retryPolicy {
+	return retryPolicy{maxAttempts: maxAttempts, backoff: time.Second, maxBackoff: time.Minute}
+}
+
+func testTariff(t *testing.T) *billing.Tariff {
+	tariff, err := billing.LoadTariff("config/tariff.json")
+	if err != nil {
+		t.Fatalf("Failed to load tariff: %s", err)
+	}
+	return tariff
+}
+
+func TestTariffFee(t *testing.T) {
+	tariff := testTariff(t)
+	tests := []struct {
+		name        string
+		entry, exit string
+		fee         int64
+	}{
+		{"grace period", "2024-01-01T10:00:00Z", "2024-01-01T10:10:00Z", 0},
+		{"tiered hours", "2024-01-01T10:00:00Z", "2024-01-01T12:30:00Z", 300 + 250 + 250},
+		{"overnight", "2024-01-01T21:00:00Z", "2024-01-02T07:00:00Z", 300 + 250 + 800},
+		{"daily cap", "2024-01-01T10:00:00Z", "2024-01-02T10:00:00Z", 2500},
+		// The second night starts in the first block and is not charged again in the second
+		{"night across blocks", "2024-01-01T23:00:00Z", "2024-01-03T00:30:00Z", 2500},
+		{"legacy format", "2024-01-01 10:00:00.5 +0000 UTC", "2024-01-01 10:59:00 +0000 UTC", 300},
+	}
+
+	for _, tt := range tests {
+		entry, err := parseEventTime(tt.entry)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		exit, err := parseEventTime(tt.exit)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		fee, err := tariff.Fee(entry, exit)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if fee != tt.fee {
+			t.Errorf("%s: expected fee %d, got %d", tt.name, tt.fee, fee)
+		}
+	}
+
+	// Both nights of a single block are charged
+	uncapped := *tariff
+	uncapped.DailyCap = 0
+	entry, exit := time.Date(2024, 1, 1, 5, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)
+	if fee, err := uncapped.Fee(entry, exit); err != nil || fee != 300+2*250+13*200+2*800 {
+		t.Errorf("Expected two overnight fees, got %d, %v", fee, err)
+	}
+
+	// Hours past a bounded last tier are billed at its rate, not for free
+	bounded := uncapped
+	bounded.Tiers = []billing.Tier{{UpToHours: 1, RatePerHour: 300}, {UpToHours: 3, RatePerHour: 250}}
+	entry, exit = time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 14, 0, 0, 0, time.UTC)
+	if fee, err := bounded.Fee(entry, exit); err != nil || fee != 300+5*250 {
+		t.Errorf("Expected the hours past the last tier at its rate, got %d, %v", fee, err)
+	}
+
+	if _, err := tariff.Fee(time.Now(), time.Now().Add(-time.Hour)); err == nil {
+		t.Errorf("Expected an error for an exit before the entry")
+	}
+}
+
+func testMatcher(review amqpPublisher) *plateMatcher {
+	return &plateMatcher{maxDistance: 2, autoMatchDistance: 1, review: review}
+}
+
+// Delivers straight to a sink, skipping the spool
+type directQueue struct {
+	sink summarySink
+}
+
+func (q directQueue) enqueue(ctx context.Context, summary billing.Summary, idempotencyKey string) error {
+	return q.sink.deliver(ctx, summary, idempotencyKey)
+}
+
+func testSinks(httpClient httpClienter) summaryQueuer {
+	return directQueue{&httpSink{client: httpClient, url: "http://writer/log"}}
+}
+
+type mockSpool struct {
+	spools map[string][]spooledSummary
+	dead   map[string][]spooledSummary
+	err    error
+}
+
+func (m *mockSpool) spoolSummary(sinks []string, entry spooledSummary) error {
+	if m.err != nil {
+		return m.err
+	}
+	for _, sink := range sinks {
+		entry.StreamId = fmt.Sprint(len(m.spools[sink]))
+		m.spools[sink] = append(m.spools[sink], entry)
+	}
+	return nil
+}
+
+func (m *mockSpool) heartbeat(consumer string, ttl time.Duration) error {
+	return nil
+}
+
+func (m *mockSpool) readSpool(sink, consumer string, count int, block time.Duration) ([]spooledSummary, error) {
+	return m.spools[sink], nil
+}
+
+func (m *mockSpool) claimStaleSpool(sink, consumer string, minIdle time.Duration, count int) ([]spooledSummary, error) {
+	return nil, nil
+}
+
+func (m *mockSpool) ackSpool(sink string, entry spooledSummary) error {
+	spool := m.spools[sink]
+	for i := range spool {
+		if spool[i].StreamId == entry.StreamId {
+			m.spools[sink] = append(spool[:i:i], spool[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *mockSpool) deadLetterSpool(sink string, entry spooledSummary, reason string) error {
+	m.dead[sink] = append(m.dead[sink], entry)
+	return m.ackSpool(sink, entry)
+}
+
+func (m *mockSpool) spoolDepth(sink string) (int64, error) {
+	return int64(len(m.spools[sink])), nil
+}
+
+type failingSink struct {
+	attempts int
+	err      error
+}
+
+func (f *failingSink) deliver(ctx context.Context, summary billing.Summary, idempotencyKey string) error {
+	f.attempts++
+	return f.err
+}
+
+func TestSummaryFanout(t *testing.T) {
+	spool := &mockSpool{spools: map[string][]spooledSummary{}, dead: map[string][]spooledSummary{}}
+	httpClient := &mockHTTPClient{}
+	failing := &failingSink{err: errors.New("sink down")}
+	out := &bytes.Buffer{}
+	slept := []time.Duration{}
+	worker := func(name string, sink summarySink, retry retryPolicy) *sinkWorker {
+		return &sinkWorker{name: name, sink: sink, retry: retry, breaker: &circuitBreaker{sink: name}, store: spool,
+			sleep: func(d time.Duration) { slept = append(slept, d) }}
+	}
+	fanout := &summaryFanout{store: spool, workers: []*sinkWorker{
+		worker("writer", &httpSink{client: httpClient, url: "http://writer/log"}, retryPolicy{}),
+		worker("webhook", failing, retryPolicy{maxAttempts: 3, backoff: time.Second, maxBackoff: 3 * time.Second}),
+		worker("stdout", &writerSink{out: out}, retryPolicy{}),
+	}}
+	before := counterValue(t, sinkDeliveries.WithLabelValues("webhook", "dead"))
+
+	// A failed enqueue spools the summary to no sink, its retry cannot duplicate it
+	spool.err = errors.New("redis unavailable")
+	if err := fanout.enqueue(context.Background(), billing.Summary{Vehicle: "ABC123"}, "1"); err == nil || len(spool.spools) != 0 {
+		t.Fatalf("Expected the enqueue to fail without spooling, got %v and %d spools", err, len(spool.spools))
+	}
+	spool.err = nil
+	if err := fanout.enqueue(context.Background(), billing.Summary{Vehicle: "ABC123"}, "1"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, w := range fanout.workers {
+		entries, _ := spool.readSpool(w.name, "", 10, 0)
+		for _, entry := range entries {
+			w.deliver(entry)
+		}
+	}
+
+	if len(httpClient.summaries) != 1 || !strings.Contains(out.String(), `"vehicle":"ABC123"`) {
+		t.Errorf("Expected the healthy sinks to get the summary despite the failing one")
+	}
+	if failing.attempts != 3 || len(spool.dead["webhook"]) != 1 {
+		t.Errorf("Expected the failing sink to dead-letter the summary after 3 attempts, got %d", failing.attempts)
+	}
+	for name, entries := range spool.spools {
+		if len(entries) != 0 {
+			t.Errorf("Expected the spool of %s to be drained, got %d", name, len(entries))
+		}
+	}
+	if counterValue(t, sinkDeliveries.WithLabelValues("webhook", "dead"))-before != 1 {
+		t.Errorf("Expected one dead-lettered summary to be counted")
+	}
+	// Backoff doubles per attempt, with jitter between half and all of it
+	if len(slept) != 2 || slept[0] < 500*time.Millisecond || slept[0] > time.Second || slept[1] < time.Second || slept[1] > 2*time.Second {
+		t.Errorf("Unexpected backoff %v", slept)
+	}
+
+	// A rejected summary is not retried
+	rejecting := &failingSink{err: permanentError{errors.New("bad request")}}
+	w := worker("webhook", rejecting, retryPolicy{backoff: time.Second})
+	w.deliver(spooledSummary{Summary: billing.Summary{Vehicle: "ABC123"}})
+	if rejecting.attempts != 1 {
+		t.Errorf("Expected a single attempt for a rejected summary, got %d", rejecting.attempts)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := &circuitBreaker{sink: "writer", threshold: 2, cooldown: time.Minute}
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	breaker.failure(now)
+	if breaker.wait(now) != 0 {
+		t.Errorf("Expected the breaker to stay closed below the threshold")
+	}
+	breaker.failure(now)
+	if breaker.wait(now) != time.Minute {
+		t.Errorf("Expected the breaker to open for the cooldown, got %s", breaker.wait(now))
+	}
+
+	// A failed trial after the cooldown opens it again
+	now = now.Add(time.Minute)
+	if breaker.wait(now) != 0 {
+		t.Errorf("Expected a trial delivery after the cooldown")
+	}
+	breaker.failure(now)
+	if breaker.wait(now) != time.Minute {
+		t.Errorf("Expected the breaker to open again after a failed trial")
+	}
+
+	now = now.Add(time.Minute)
+	breaker.success()
+	breaker.failure(now)
+	if breaker.wait(now) != 0 {
+		t.Errorf("Expected a successful trial to close the breaker")
+	}
+}
+
+func TestEventMetrics(t *testing.T) {
+	database := newMapDatabase(session{Id: "1", VehiclePlate: "ABC123", State: sessionOpen, EntryEventId: "1", EntryDateTime: "2021-01-01T00:00:00Z"})
+	matched := counterValue(t, eventOutcomes.WithLabelValues("exit", outcomeMatched, defaultGarage, ""))
+	malformed := counterValue(t, eventOutcomes.WithLabelValues("exit", outcomeMalformed, "", ""))
+	lag := histogramCount(t, eventLag.WithLabelValues("exit", defaultGarage, ""))
+	// The malformed exit has no garage
+	processing := histogramCount(t, exitProcessing.WithLabelValues(defaultGarage)) + histogramCount(t, exitProcessing.WithLabelValues(""))
+
+	body := []byte(`{"id":"2","vehicle_plate":"ABC123","exit_date_time":"2021-01-01T02:00:00Z"}`)
+	if err := exitEventFunc(amqp.Delivery{Body: body}, database, testTariff(t), testMatcher(&mockPublisher{}), nil, testSinks(&mockHTTPClient{})); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	exitEventFunc(amqp.Delivery{Body: []byte(`not json`)}, database, testTariff(t), testMatcher(&mockPublisher{}), nil, testSinks(&mockHTTPClient{}))
+
+	if counterValue(t, eventOutcomes.WithLabelValues("exit", outcomeMatched, defaultGarage, ""))-matched != 1 {
+		t.Errorf("Expected one matched exit to be counted")
+	}
+	if counterValue(t, eventOutcomes.WithLabelValues("exit", outcomeMalformed, "", ""))-malformed != 1 {
+		t.Errorf("Expected one malformed exit to be counted")
+	}
+	if histogramCount(t, eventLag.WithLabelValues("exit", defaultGarage, ""))-lag != 1 {
+		t.Errorf("Expected the lag of the well-formed exit to be observed")
+	}
+	if histogramCount(t, exitProcessing.WithLabelValues(defaultGarage))+histogramCount(t, exitProcessing.WithLabelValues(""))-processing != 2 {
+		t.Errorf("Expected the processing time of both exits to be observed")
+	}
+	gauge := &dto.Metric{}
+	if err := occupancy.WithLabelValues(defaultGarage).Write(gauge); err != nil {
+		t.Fatalf("Failed to read gauge: %s", err)
+	}
+	if gauge.GetGauge().GetValue() != 0 {
+		t.Errorf("Expected the garage to be empty after the exit, got %v", gauge.GetGauge().GetValue())
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	database := newMapDatabase(session{Id: "1", VehiclePlate: "ABC123", State: sessionOpen, EntryEventId: "1", EntryDateTime: "2021-01-01T00:00:00Z"})
+	httpClient := &mockHTTPClient{}
+	d := amqp.Delivery{
+		Headers: amqp.Table{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+		Body:    []byte(`{"id":"2","vehicle_plate":"ABC123","exit_date_time":"2021-01-01T02:00:00Z"}`),
+	}
+	if err := exitEventFunc(d, database, testTariff(t), testMatcher(&mockPublisher{}), nil, testSinks(httpClient)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) == 0 {
+		t.Fatalf("Expected the exit to be traced")
+	}
+	span := spans[len(spans)-1]
+	if span.Name != "process exit-event" || span.SpanContext.TraceID().String() != "0af7651916cd43dd8448eb211c80319c" || span.Parent.SpanID().String() != "b7ad6b7169203331" {
+		t.Errorf("Expected the consumer span to continue the publisher's trace, got %+v", span)
+	}
+	if len(httpClient.traceparents) != 1 || !strings.HasPrefix(httpClient.traceparents[0], "00-0af7651916cd43dd8448eb211c80319c-") {
+		t.Errorf("Expected the summary POST to carry the trace, got %v", httpClient.traceparents)
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "summaries.ndjson")
+	sink := &fileSink{path: path, maxBytes: 300, maxFiles: 2}
+
+	for i := 0; i < 10; i++ {
+		if err := sink.deliver(context.Background(), billing.Summary{Vehicle: "ABC123"}, ""); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Expected %s to exist: %s", name, err)
+		}
+		if info.Size() > 300 {
+			t.Errorf("Expected %s to stay within 300 bytes, got %d", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected at most 2 rotated files")
+	}
+}
+
+func TestPlateDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		distance float64
+	}{
+		{"ABC123", "ABC123", 0},
+		{"ABC123", "A8C123", 0.3},
+		{"OBC123", "0BC123", 0.2},
+		{"ABC123", "ABC12", 1},
+		{"ABC123", "XYZ123", 3},
+	}
+	for _, tt := range tests {
+		if distance := plateDistance(tt.a, tt.b); math.Abs(distance-tt.distance) > 1e-9 {
+			t.Errorf("Expected distance %v between %s and %s, got %v", tt.distance, tt.a, tt.b, distance)
+		}
+	}
+}
+
+func TestExitEventFuncFuzzyMatch(t *testing.T) {
+	database := newMapDatabase(session{Id: "1", VehiclePlate: "ABC123", State: sessionOpen, EntryEventId: "1", EntryDateTime: "2021-01-01T00:00:00Z"})
+	body := []byte(`{"id":"2","vehicle_plate":"A8C123","exit_date_time":"2021-01-01T02:00:00Z"}`)
+	httpClient := &mockHTTPClient{}
+
+	if err := exitEventFunc(amqp.Delivery{Body: body}, database, testTariff(t), testMatcher(&mockPublisher{}), nil, testSinks(httpClient)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if database.sessions["1"].State != sessionClosed {
+		t.Errorf("Expected the misread plate to close the open session")
+	}
+	if len(httpClient.summaries) != 1 || httpClient.summaries[0].MatchType != string(matchFuzzy) || httpClient.summaries[0].MatchedPlate != "ABC123" {
+		t.Errorf("Expected a fuzzy matched summary, got %+v", httpClient.summaries)
+	}
+}
+
+func TestExitEventFuncReview(t *testing.T) {
+	database := newMapDatabase(
+		session{Id: "1", VehiclePlate: "ABC123", State: sessionOpen, EntryEventId: "1", EntryDateTime: "2021-01-01T00:00:00Z"},
+		session{Id: "2", VehiclePlate: "ABC128", State: sessionOpen, EntryEventId: "2", EntryDateTime: "2021-01-01T00:00:00Z"},
+	)
+	body := []byte(`{"id":"3","vehicle_plate":"ABC12","exit_date_time":"2021-01-01T02:00:00Z"}`)
+	httpClient := &mockHTTPClient{}
+	review := &mockPublisher{}
+
+	if err := exitEventFunc(amqp.Delivery{Body: body}, database, testTariff(t), testMatcher(review), nil, testSinks(httpClient)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(review.published) != 1 || review.published[0].key != reviewQueueName {
+		t.Errorf("Expected the ambiguous exit to be sent to review, got %+v", review.published)
+	}
+	if len(httpClient.summaries) != 0 {
+		t.Errorf("Expected no summary for an exit under review")
+	}
+}
+
+func TestGarageIsolation(t *testing.T) {
+	database := newMapDatabase()
+	httpClient := &mockHTTPClient{}
+	entry := []byte(`{"id":"1","vehicle_plate":"ABC123","entry_date_time":"2021-01-01T00:00:00Z","garage_id":"north","gate_id":"n-in","lane_id":"2"}`)
+	if err := entryEventFunc(amqp.Delivery{Body: entry}, database, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The same plate leaving another garage is another vehicle, nor is a near plate there a candidate
+	for _, plate := range []string{"ABC123", "A8C123"} {
+		exit := []byte(`{"id":"x` + plate + `","vehicle_plate":"` + plate + `","exit_date_time":"2021-01-01T02:00:00Z","garage_id":"south","gate_id":"s-out"}`)
+		if err := exitEventFunc(amqp.Delivery{Body: exit}, database, testTariff(t), testMatcher(&mockPublisher{}), nil, testSinks(httpClient)); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if database.sessions["1"].State != sessionOpen {
+		t.Fatalf("Expected the session in north to stay open")
+	}
+	for _, summary := range httpClient.summaries {
+		if summary.MatchType != string(matchUnmatched) || summary.GarageId != "south" {
+			t.Errorf("Expected unmatched summaries in south, got %+v", summary)
+		}
+	}
+
+	httpClient.summaries = nil
+	exit := []byte(`{"id":"2","vehicle_plate":"ABC123","exit_date_time":"2021-01-01T02:00:00Z","garage_id":"north","gate_id":"n-out","lane_id":"1"}`)
+	if err := exitEventFunc(amqp.Delivery{Body: exit}, database, testTariff(t), testMatcher(&mockPublisher{}), nil, testSinks(httpClient)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(httpClient.summaries) != 1 {
+		t.Fatalf("Expected one summary, got %+v", httpClient.summaries)
+	}
+	got := httpClient.summaries[0]
+	if got.MatchType != string(matchExact) || got.GarageId != "north" ||
+		got.EntryGateId != "n-in" || got.EntryLaneId != "2" || got.ExitGateId != "n-out" || got.ExitLaneId != "1" {
+		t.Errorf("Expected an exact match from gate n-in to n-out of north, got %+v", got)
+	}
+}
+
+type mockOrphanStore struct {
+	stale  []session
+	locked bool
+}
+
+func (m *mockOrphanStore) orphanSessions(cutoff time.Time) ([]session, error) {
+	orphaned := m.stale
+	m.stale = nil
+	return orphaned, nil
+}
+
+func (m *mockOrphanStore) garages() ([]string, error) {
+	return []string{defaultGarage}, nil
+}
+
+func (m *mockOrphanStore) orphanedSessionCount(garage string) (int64, error) {
+	return 1, nil
+}
+
+func (m *mockOrphanStore) acquireLock(name, token string, ttl time.Duration) (bool, error) {
+	if m.locked {
+		return false, nil
+	}
+	m.locked = true
+	return true, nil
+}
+
+func (m *mockOrphanStore) releaseLock(name, token string) error {
+	m.locked = false
+	return nil
+}
+
+func TestGateLabel(t *testing.T) {
+	gates, err := parseGates("north=n-in|n-out, south=s-in")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	metricGates = gates
+	defer func() { metricGates = map[string]map[string]bool{} }()
+
+	for _, c := range []struct{ garage, gate, want string }{
+		{"north", "n-in", "n-in"},
+		{"south", "s-in", "s-in"},
+		{"south", "n-in", otherGate},
+		{"north", "made-up", otherGate},
+		{"unknown", "n-in", otherGate},
+		{"north", "", ""},
+	} {
+		if got := gateLabel(c.garage, c.gate); got != c.want {
+			t.Errorf("gateLabel(%q, %q) = %q, want %q", c.garage, c.gate, got, c.want)
+		}
+	}
+	if _, err := parseGates("north"); err == nil {
+		t.Errorf("Expected an error for a garage without gates")
+	}
+}
+
+func TestOrphanSweeper(t *testing.T) {
+	database := &mockOrphanStore{stale: []session{{Id: "1", VehiclePlate: "ABC123", State: sessionOrphaned}}}
+	publisher := &mockPublisher{}
+	sweeper := &orphanSweeper{database: database, publisher: publisher, maxStay: time.Hour, interval: time.Minute, token: "a"}
+
+	// Another replica holds the lock
+	database.locked = true
+	if n, err := sweeper.sweep(time.Now()); err != nil || n != 0 {
+		t.Fatalf("Expected no sweep without the lock, got %d, %v", n, err)
+	}
+
+	database.locked = false
+	if n, err := sweeper.sweep(time.Now()); err != nil || n != 1 {
+		t.Fatalf("Expected one orphaned session, got %d, %v", n, err)
+	}
+	if len(publisher.published) != 1 || publisher.published[0].key != orphanedQueueName {
+		t.Errorf("Expected an orphaned-session event, got %+v", publisher.published)
+	}
+	if database.locked {
+		t.Errorf("Expected the lock to be released after the sweep")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	breaker := &circuitBreaker{sink: "writer", threshold: 1, cooldown: time.Minute}
+	fanout := &summaryFanout{workers: []*sinkWorker{{name: "writer", breaker: breaker}}}
+	redisDown := errors.New("connection refused")
+	handler := &health.Handler{
+		Live: func() error { return nil },
+		Checks: append([]health.Check{
+			{Name: "amqp", Check: func(ctx context.Context) error { return nil }},
+			{Name: "redis", Check: func(ctx context.Context) error { return redisDown }},
+		}, fanout.healthChecks()...),
+	}
+	mux := http.NewServeMux()
+	handler.Register(mux)
+
+	ready := func() (int, health.Response) {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+		response := health.Response{}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode response: %s", err)
+		}
+		return recorder.Code, response
+	}
+
+	code, response := ready()
+	if code != http.StatusServiceUnavailable || response.Dependencies["redis"].Status != "down" || response.Dependencies["amqp"].Status != "ok" {
+		t.Errorf("Expected not ready while Redis is down, got %d %+v", code, response)
+	}
+
+	// An open writer circuit degrades the backend, summaries are still spooled
+	redisDown = nil
+	breaker.failure(time.Now())
+	code, response = ready()
+	if code != http.StatusOK || response.Status != "degraded" || response.Dependencies["sink:writer"].Status != "degraded" {
+		t.Errorf("Expected ready but degraded while the writer circuit is open, got %d %+v", code, response)
+	}
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected live, got %d", recorder.Code)
+	}
+}
+
+func TestRabbitmqConnectionDown(t *testing.T) {
+	rabbitmq := &rabbitmqConnection{maxDowntime: time.Minute}
+	rabbitmq.lost()
+
+	err := rabbitmq.PublishWithContext(context.Background(), "", exitQueueName, false, false, amqp.Publishing{})
+	if err == nil {
+		t.Errorf("Expected publishing to fail while reconnecting")
+	}
+	if err := rabbitmq.ready(context.Background()); err == nil {
+		t.Errorf("Expected not ready while reconnecting")
+	}
+	if err := rabbitmq.live(); err != nil {
+		t.Errorf("Expected live within the maximum downtime, got %s", err)
+	}
+
+	rabbitmq.downSince = time.Now().Add(-2 * time.Minute)
+	if err := rabbitmq.live(); err == nil {
+		t.Errorf("Expected not live after the maximum downtime")
+	}
+}
+
+func TestQueryAPI(t *testing.T) {
+	database := newMapDatabase(
+		session{Id: "1", VehiclePlate: "ABC123", State: sessionOpen, EntryEventId: "1", EntryDateTime: "2021-01-01T10:00:00Z"},
+		session{Id: "2", VehiclePlate: "XYZ789", State: sessionOpen, EntryEventId: "2", EntryDateTime: "2021-01-01T11:00:00Z"},
+	)
+	now := func() time.Time { return time.Date(2021, 1, 1, 12, 30, 0, 0, time.UTC) }
+	api := &queryAPI{database: database, tariff: testTariff(t), capacities: garageCapacities{fallback: 100}, now: now}
+	mux := http.NewServeMux()
+	api.register(mux)
+
+	get := func(path string, status int, body interface{}) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != status {
+			t.Fatalf("GET %s: expected status %d, got %d: %s", path, status, recorder.Code, recorder.Body)
+		}
+		if body != nil {
+			if err := json.NewDecoder(recorder.Body).Decode(body); err != nil {
+				t.Fatalf("GET %s: %s", path, err)
+			}
+		}
+	}
+
+	occupancy := occupancyResponse{}
+	get("/occupancy", http.StatusOK, &occupancy)
+	if occupancy.Occupied != 2 || occupancy.Capacity != 100 || occupancy.GarageId != defaultGarage {
+		t.Errorf("Unexpected occupancy %+v", occupancy)
+	}
+	get("/occupancy?garage=north", http.StatusOK, &occupancy)
+	if occupancy.Occupied != 0 || occupancy.GarageId != "north" {
+		t.Errorf("Expected north to be empty, got %+v", occupancy)
+	}
+	get("/fee-estimate/ABC123?garage=north", http.StatusNotFound, nil)
+
+	plateSessions := plateSessionsResponse{}
+	get("/sessions/ABC123", http.StatusOK, &plateSessions)
+	if plateSessions.Current == nil || plateSessions.Current.Id != "1" {
+		t.Errorf("Expected the open session as current, got %+v", plateSessions)
+	}
+
+	page := sessionPageResponse{}
+	get("/sessions?state=open&limit=1", http.StatusOK, &page)
+	if len(page.Sessions) != 1 || page.NextOffset == nil || *page.NextOffset != 1 {
+		t.Errorf("Expected a first page with a next offset, got %+v", page)
+	}
+	get("/sessions?state=closed", http.StatusBadRequest, nil)
+
+	estimate := feeEstimateResponse{}
+	get("/fee-estimate/ABC123", http.StatusOK, &estimate)
+	if estimate.Fee != 300+250+250 || estimate.DurationSeconds != 9000 {
+		t.Errorf("Unexpected fee estimate %+v", estimate)
+	}
+	get("/fee-estimate/NOPE00", http.StatusNotFound, nil)
+	get("/openapi.json", http.StatusOK, &map[string]interface{}{})
+}
+
+func histogramCount(t *testing.T, histogram prometheus.Observer) uint64 {
+	metric := &dto.Metric{}
+	if err := histogram.(prometheus.Metric).Write(metric); err != nil {
+		t.Fatalf("Failed to read histogram: %s", err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	metric := &dto.Metric{}
+	if err := counter.Write(metric); err != nil {
+		t.Fatalf("Failed to read counter: %s", err)
+	}
+	return metric.GetCounter().GetValue()
 }
@@ -0,0 +1,32 @@
+package billing
+
+// How an exit was paired with its entry, in Summary.MatchType
+const (
+	MatchExact     = "exact"
+	MatchFuzzy     = "fuzzy"
+	MatchReview    = "review"
+	MatchUnmatched = "unmatched"
+)
+
+// Summary delivered to the summary sinks once a vehicle leaves. Fee is in minor units of Currency.
+type Summary struct {
+	Vehicle         string `json:"vehicle"`
+	SessionId       string `json:"sessionId,omitempty"`
+	EntryTime       string `json:"entryTime"`
+	ExitTime        string `json:"exitTime"`
+	DurationSeconds int64  `json:"durationSeconds"`
+	Fee             int64  `json:"fee"`
+	Currency        string `json:"currency"`
+	TariffVersion   string `json:"tariffVersion"`
+	// How the exit was paired with its entry, one of the Match constants. MatchedPlate is the entry
+	// plate of a fuzzy match.
+	MatchType    string  `json:"matchType"`
+	MatchScore   float64 `json:"matchScore"`
+	MatchedPlate string  `json:"matchedPlate,omitempty"`
+	// Where the vehicle entered and left, there is no entry gate without a matched entry
+	GarageId    string `json:"garageId"`
+	EntryGateId string `json:"entryGateId,omitempty"`
+	EntryLaneId string `json:"entryLaneId,omitempty"`
+	ExitGateId  string `json:"exitGateId,omitempty"`
+	ExitLaneId  string `json:"exitLaneId,omitempty"`
+}
@@ -0,0 +1,197 @@
+// Package billing prices parking stays and describes the summaries they are billed in.
+package billing
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// One step of the hourly rate table. Hours up to UP_TO_HOURS within a day are billed at
+// RATE_PER_HOUR, a zero UP_TO_HOURS means the tier is open-ended and has to come last.
+// Hours past a bounded last tier are billed at its rate.
+type Tier struct {
+	UpToHours   int   `json:"UP_TO_HOURS"`
+	RatePerHour int64 `json:"RATE_PER_HOUR"`
+}
+
+// Flat fee charged once per night the vehicle is parked inside the window. START and END are
+// "15:04" clock times in UTC, an END before START wraps over midnight.
+type OvernightRate struct {
+	Start   string `json:"START"`
+	End     string `json:"END"`
+	FlatFee int64  `json:"FLAT_FEE"`
+}
+
+// Rate table loaded from the tariff config file. All amounts are in minor currency units.
+type Tariff struct {
+	Version            string         `json:"VERSION"`
+	Currency           string         `json:"CURRENCY"`
+	GracePeriodMinutes int            `json:"GRACE_PERIOD_MINUTES"`
+	Tiers              []Tier         `json:"TIERS"`
+	DailyCap           int64          `json:"DAILY_CAP"`
+	Overnight          *OvernightRate `json:"OVERNIGHT"`
+	LostEntryFee       int64          `json:"LOST_ENTRY_FEE"`
+
+	overnightStart time.Duration
+	overnightEnd   time.Duration
+}
+
+// LoadTariff reads and validates the tariff config file at path
+func LoadTariff(path string) (*Tariff, error) {
+	tariffFile, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tariff file: %w", err)
+	}
+	defer tariffFile.Close()
+
+	t := &Tariff{}
+	err = json.NewDecoder(tariffFile).Decode(t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tariff file: %w", err)
+	}
+
+	err = t.validate()
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Tariff) validate() error {
+	if t.Version == "" || t.Currency == "" {
+		return fmt.Errorf("tariff VERSION and CURRENCY must be set")
+	}
+	if len(t.Tiers) == 0 {
+		return fmt.Errorf("tariff must define at least one tier")
+	}
+	for i, tier := range t.Tiers {
+		last := i == len(t.Tiers)-1
+		if tier.UpToHours == 0 && !last {
+			return fmt.Errorf("only the last tariff tier can be open-ended")
+		}
+		if i > 0 && tier.UpToHours != 0 && tier.UpToHours <= t.Tiers[i-1].UpToHours {
+			return fmt.Errorf("tariff tiers must be in increasing UP_TO_HOURS order")
+		}
+	}
+
+	if t.Overnight != nil {
+		var err error
+		t.overnightStart, err = parseClock(t.Overnight.Start)
+		if err != nil {
+			return fmt.Errorf("invalid overnight START: %w", err)
+		}
+		t.overnightEnd, err = parseClock(t.Overnight.End)
+		if err != nil {
+			return fmt.Errorf("invalid overnight END: %w", err)
+		}
+	}
+	return nil
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// Fee computes what is owed for a stay from entry to exit.
+//
+// Stays within the grace period are free. Longer stays are billed in 24 hour blocks counted
+// from entry: daytime minutes of a block are rounded up to whole hours and priced through the
+// tiers, every night the stay touches adds the overnight flat fee once, to the block in which the
+// stay's part of the night begins, and the block total is limited to the daily cap.
+func (t *Tariff) Fee(entry, exit time.Time) (int64, error) {
+	if exit.Before(entry) {
+		return 0, fmt.Errorf("exit %s is before entry %s", exit, entry)
+	}
+	entry, exit = entry.UTC(), exit.UTC()
+	if exit.Sub(entry) <= time.Duration(t.GracePeriodMinutes)*time.Minute {
+		return 0, nil
+	}
+
+	nights := []time.Time{}
+	t.overnightWindows(entry, exit, func(from, to time.Time) {
+		nights = append(nights, from)
+	})
+
+	var total int64
+	for blockStart := entry; blockStart.Before(exit); blockStart = blockStart.Add(24 * time.Hour) {
+		blockEnd := blockStart.Add(24 * time.Hour)
+		if blockEnd.After(exit) {
+			blockEnd = exit
+		}
+
+		var overnight time.Duration
+		t.overnightWindows(blockStart, blockEnd, func(from, to time.Time) {
+			overnight += to.Sub(from)
+		})
+		daytime := blockEnd.Sub(blockStart) - overnight
+		hours := int((daytime + time.Hour - 1) / time.Hour)
+
+		blockFee := t.hourlyFee(hours)
+		for _, night := range nights {
+			if !night.Before(blockStart) && night.Before(blockEnd) {
+				blockFee += t.Overnight.FlatFee
+			}
+		}
+		if t.DailyCap > 0 && blockFee > t.DailyCap {
+			blockFee = t.DailyCap
+		}
+		total += blockFee
+	}
+	return total, nil
+}
+
+func (t *Tariff) hourlyFee(hours int) int64 {
+	var fee int64
+	billed := 0
+	for _, tier := range t.Tiers {
+		if billed >= hours {
+			break
+		}
+		inTier := hours - billed
+		if tier.UpToHours != 0 && tier.UpToHours-billed < inTier {
+			inTier = tier.UpToHours - billed
+		}
+		fee += int64(inTier) * tier.RatePerHour
+		billed += inTier
+	}
+	// The last tier is bounded and the stay ran past it
+	if billed < hours {
+		fee += int64(hours-billed) * t.Tiers[len(t.Tiers)-1].RatePerHour
+	}
+	return fee
+}
+
+// overnightWindows calls overlap with the part of [start, end) that falls into each overnight
+// window, once per night
+func (t *Tariff) overnightWindows(start, end time.Time, overlap func(from, to time.Time)) {
+	if t.Overnight == nil {
+		return
+	}
+
+	// A window opening the day before start can still be running at start
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -1)
+	for ; day.Before(end); day = day.AddDate(0, 0, 1) {
+		windowStart := day.Add(t.overnightStart)
+		windowEnd := day.Add(t.overnightEnd)
+		if t.overnightEnd <= t.overnightStart {
+			windowEnd = windowEnd.AddDate(0, 0, 1)
+		}
+
+		from, to := windowStart, windowEnd
+		if start.After(from) {
+			from = start
+		}
+		if end.Before(to) {
+			to = end
+		}
+		if to.After(from) {
+			overlap(from, to)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+// Command score reports how accurately the backend billed a simulator run:
+//
+//	score [-tariff path] [-json] <ground truth> <summaries>...
+//
+// The ground truth is the simulator's GROUND_TRUTH_PATH log, the summaries are NDJSON as written
+// by the file sink or the writer.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"backend/billing"
+	"groundtruth"
+)
+
+// Garage of events and summaries without a garage id, as in the backend
+const defaultGarage = "default"
+
+func garageOrDefault(garage string) string {
+	if garage == "" {
+		return defaultGarage
+	}
+	return garage
+}
+
+// parseEventTime parses the RFC 3339 times of the ground truth and the summaries
+func parseEventTime(value string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// How well the summaries match the ground truth. Fees are in minor units of the tariff currency.
+type scoreReport struct {
+	// Exits the cameras published, and those without a summary, such as exits sent to review
+	Exits   int `json:"exits"`
+	Missing int `json:"missing"`
+	// Summaries with no published exit, and extra summaries for the same exit
+	UnknownSummaries   int `json:"unknownSummaries"`
+	DuplicateSummaries int `json:"duplicateSummaries"`
+
+	// Exits whose entry was published and which were matched to that entry
+	ShouldMatch      int `json:"shouldMatch"`
+	CorrectlyMatched int `json:"correctlyMatched"`
+	// Exits whose entry was dropped and which were billed as unmatched
+	ShouldNotMatch     int `json:"shouldNotMatch"`
+	CorrectlyUnmatched int `json:"correctlyUnmatched"`
+
+	// Exits read with another plate than their entry, fuzzy matches made and the correct ones
+	FuzzyNeeded  int `json:"fuzzyNeeded"`
+	FuzzyMatches int `json:"fuzzyMatches"`
+	FuzzyCorrect int `json:"fuzzyCorrect"`
+
+	// Billed against true durations and fees
+	Billed             int     `json:"billed"`
+	DurationErrorTotal float64 `json:"durationErrorMinutes"`
+	FeeErrorTotal      int64   `json:"feeErrorTotal"`
+	FeeErrorNet        int64   `json:"feeErrorNet"`
+	Currency           string  `json:"currency"`
+}
+
+func ratio(part, whole int) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return float64(part) / float64(whole)
+}
+
+// Entry and exit of one vehicle's real stay
+type visit struct {
+	entry *groundtruth.Record
+	exit  groundtruth.Record
+}
+
+// Plate within a garage, the same plate in two garages belongs to two stays
+type garagePlate struct {
+	garage string
+	plate  string
+}
+
+// visits pairs every exit with the latest entry of the same real plate in the same garage
+func visits(records []groundtruth.Record) []visit {
+	sorted := append([]groundtruth.Record{}, records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return eventTimeBefore(sorted[i].Time, sorted[j].Time)
+	})
+
+	entered := map[garagePlate]*groundtruth.Record{}
+	paired := []visit{}
+	for i := range sorted {
+		record := &sorted[i]
+		key := garagePlate{garageOrDefault(record.GarageId), record.Plate}
+		switch record.Event {
+		case "entry":
+			entered[key] = record
+		case "exit":
+			paired = append(paired, visit{entry: entered[key], exit: *record})
+			delete(entered, key)
+		}
+	}
+	return paired
+}
+
+func eventTimeBefore(a, b string) bool {
+	parsedA, errA := parseEventTime(a)
+	parsedB, errB := parseEventTime(b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return parsedA.Before(parsedB)
+}
+
+// Summaries are found by the garage and by the exit plate and time as the camera published them
+type summaryKey struct {
+	garage string
+	plate  string
+	exit   int64
+}
+
+func keyOf(garage, plate, exitTime string) (summaryKey, bool) {
+	parsed, err := parseEventTime(exitTime)
+	if err != nil {
+		return summaryKey{}, false
+	}
+	return summaryKey{garage: garageOrDefault(garage), plate: plate, exit: parsed.UnixNano()}, true
+}
+
+// score joins the ground truth with the summaries
+func score(records []groundtruth.Record, summaries []billing.Summary, tariff *billing.Tariff) scoreReport {
+	report := scoreReport{Currency: tariff.Currency}
+
+	byExit := map[summaryKey]billing.Summary{}
+	for _, summary := range summaries {
+		key, ok := keyOf(summary.GarageId, summary.Vehicle, summary.ExitTime)
+		if !ok {
+			report.UnknownSummaries++
+			continue
+		}
+		if _, ok := byExit[key]; ok {
+			report.DuplicateSummaries++
+			continue
+		}
+		byExit[key] = summary
+	}
+
+	for _, visit := range visits(records) {
+		exit := visit.exit
+		if exit.PublishedPlate == "" {
+			continue
+		}
+		report.Exits++
+		key, _ := keyOf(exit.GarageId, exit.PublishedPlate, exit.PublishedTime)
+		summary, ok := byExit[key]
+		if !ok {
+			report.Missing++
+			continue
+		}
+		delete(byExit, key)
+
+		entry := visit.entry
+		entryPublished := entry != nil && entry.PublishedPlate != ""
+		matched := summary.MatchType == billing.MatchExact || summary.MatchType == billing.MatchFuzzy
+		correct := matched && entryPublished && sameEventTime(summary.EntryTime, entry.PublishedTime)
+		if entryPublished {
+			report.ShouldMatch++
+			if correct {
+				report.CorrectlyMatched++
+			}
+		} else {
+			report.ShouldNotMatch++
+			if !matched {
+				report.CorrectlyUnmatched++
+			}
+		}
+
+		if entryPublished && entry.PublishedPlate != exit.PublishedPlate {
+			report.FuzzyNeeded++
+		}
+		if summary.MatchType == billing.MatchFuzzy {
+			report.FuzzyMatches++
+			if correct {
+				report.FuzzyCorrect++
+			}
+		}
+
+		if entry == nil {
+			continue
+		}
+		entryTime, err := parseEventTime(entry.Time)
+		if err != nil {
+			continue
+		}
+		exitTime, err := parseEventTime(exit.Time)
+		if err != nil {
+			continue
+		}
+		trueFee, err := tariff.Fee(entryTime, exitTime)
+		if err != nil {
+			continue
+		}
+		report.Billed++
+		report.DurationErrorTotal += abs(float64(summary.DurationSeconds)-exitTime.Sub(entryTime).Seconds()) / 60
+		report.FeeErrorTotal += abs(summary.Fee - trueFee)
+		report.FeeErrorNet += summary.Fee - trueFee
+	}
+	report.UnknownSummaries += len(byExit)
+	return report
+}
+
+func sameEventTime(a, b string) bool {
+	parsedA, errA := parseEventTime(a)
+	parsedB, errB := parseEventTime(b)
+	return errA == nil && errB == nil && parsedA.Equal(parsedB)
+}
+
+func abs[T int64 | float64](value T) T {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
+
+func (r scoreReport) write(out io.Writer) {
+	fmt.Fprintf(out, "Exits published:         %d, without summary: %d\n", r.Exits, r.Missing)
+	fmt.Fprintf(out, "Summaries unknown:       %d, duplicate: %d\n", r.UnknownSummaries, r.DuplicateSummaries)
+	fmt.Fprintf(out, "Matched accuracy:        %.1f%% (%d of %d exits with a published entry)\n",
+		100*ratio(r.CorrectlyMatched, r.ShouldMatch), r.CorrectlyMatched, r.ShouldMatch)
+	fmt.Fprintf(out, "Unmatched accuracy:      %.1f%% (%d of %d exits whose entry was dropped)\n",
+		100*ratio(r.CorrectlyUnmatched, r.ShouldNotMatch), r.CorrectlyUnmatched, r.ShouldNotMatch)
+	fmt.Fprintf(out, "Fuzzy match precision:   %.1f%% (%d of %d fuzzy matches)\n",
+		100*ratio(r.FuzzyCorrect, r.FuzzyMatches), r.FuzzyCorrect, r.FuzzyMatches)
+	fmt.Fprintf(out, "Fuzzy match recall:      %.1f%% (%d of %d misread plates)\n",
+		100*ratio(r.FuzzyCorrect, r.FuzzyNeeded), r.FuzzyCorrect, r.FuzzyNeeded)
+	if r.Billed > 0 {
+		fmt.Fprintf(out, "Mean duration error:     %.1f minutes\n", r.DurationErrorTotal/float64(r.Billed))
+		fmt.Fprintf(out, "Mean fee error:          %.1f %s minor units\n", float64(r.FeeErrorTotal)/float64(r.Billed), r.Currency)
+	}
+	fmt.Fprintf(out, "Net fee error:           %+d %s minor units over %d summaries\n", r.FeeErrorNet, r.Currency, r.Billed)
+}
+
+// readNDJSON decodes one value per line of path into values
+func readNDJSON[T any](path string) ([]T, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := []T{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var value T
+		if err := json.Unmarshal(scanner.Bytes(), &value); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		values = append(values, value)
+	}
+	return values, scanner.Err()
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	flags := flag.NewFlagSet("score", flag.ContinueOnError)
+	tariffPath := flags.String("tariff", "config/tariff.json", "tariff the summaries were billed with")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 2 {
+		fmt.Fprintln(os.Stderr, "usage: score [-tariff path] [-json] <ground truth> <summaries>...")
+		return 2
+	}
+
+	tariff, err := billing.LoadTariff(*tariffPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	records, err := readNDJSON[groundtruth.Record](flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read ground truth: ", err)
+		return 1
+	}
+	summaries := []billing.Summary{}
+	for _, path := range flags.Args()[1:] {
+		read, err := readNDJSON[billing.Summary](path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to read summaries: ", err)
+			return 1
+		}
+		summaries = append(summaries, read...)
+	}
+
+	report := score(records, summaries, tariff)
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		return 0
+	}
+	report.write(os.Stdout)
+	return 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"backend/billing"
+	"groundtruth"
+)
+
+func TestScore(t *testing.T) {
+	tariff, err := billing.LoadTariff("../../config/tariff.json")
+	if err != nil {
+		t.Fatalf("Failed to load tariff: %s", err)
+	}
+	records := []groundtruth.Record{
+		{Event: "entry", Plate: "AAA111", Time: "2024-01-01T10:00:00Z", PublishedPlate: "AAA111", PublishedTime: "2024-01-01T10:00:00Z"},
+		{Event: "entry", Plate: "BBB222", Time: "2024-01-01T10:05:00Z", Faults: []string{"dropped"}},
+		{Event: "entry", Plate: "CBC333", Time: "2024-01-01T10:10:00Z", PublishedPlate: "C8C333", PublishedTime: "2024-01-01T10:10:00Z", Faults: []string{"misread"}},
+		{Event: "entry", Plate: "DDD444", Time: "2024-01-01T10:15:00Z", PublishedPlate: "DDD444", PublishedTime: "2024-01-01T10:15:00Z"},
+		{Event: "exit", Plate: "AAA111", Time: "2024-01-01T12:00:00Z", PublishedPlate: "AAA111", PublishedTime: "2024-01-01T12:00:00Z"},
+		{Event: "exit", Plate: "BBB222", Time: "2024-01-01T12:05:00Z", PublishedPlate: "BBB222", PublishedTime: "2024-01-01T12:05:00Z"},
+		{Event: "exit", Plate: "CBC333", Time: "2024-01-01T12:10:00Z", PublishedPlate: "CBC333", PublishedTime: "2024-01-01T12:10:00Z"},
+		{Event: "exit", Plate: "DDD444", Time: "2024-01-01T12:15:00Z", PublishedPlate: "DDD444", PublishedTime: "2024-01-01T12:15:00Z"},
+	}
+	twoHours, _ := tariff.Fee(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	summaries := []billing.Summary{
+		{Vehicle: "AAA111", EntryTime: "2024-01-01T10:00:00Z", ExitTime: "2024-01-01T12:00:00Z", DurationSeconds: 7200, Fee: twoHours, MatchType: "exact"},
+		{Vehicle: "BBB222", EntryTime: "2024-01-01T12:05:00Z", ExitTime: "2024-01-01T12:05:00Z", Fee: tariff.LostEntryFee, MatchType: "unmatched"},
+		{Vehicle: "CBC333", EntryTime: "2024-01-01T10:10:00Z", ExitTime: "2024-01-01T12:10:00Z", DurationSeconds: 7200, Fee: twoHours, MatchType: "fuzzy", MatchedPlate: "C8C333"},
+		{Vehicle: "ZZZ999", EntryTime: "2024-01-01T10:00:00Z", ExitTime: "2024-01-01T12:00:00Z", MatchType: "exact"},
+	}
+
+	report := score(records, summaries, tariff)
+	expected := scoreReport{
+		Exits: 4, Missing: 1, UnknownSummaries: 1,
+		ShouldMatch: 2, CorrectlyMatched: 2, ShouldNotMatch: 1, CorrectlyUnmatched: 1,
+		FuzzyNeeded: 1, FuzzyMatches: 1, FuzzyCorrect: 1,
+		Billed: 3, DurationErrorTotal: 120, FeeErrorTotal: tariff.LostEntryFee - twoHours, FeeErrorNet: tariff.LostEntryFee - twoHours,
+		Currency: tariff.Currency,
+	}
+	if report != expected {
+		t.Errorf("Expected %+v, got %+v", expected, report)
+	}
+
+	// The same plate in two garages makes two stays
+	paired := visits([]groundtruth.Record{
+		{Event: "entry", Plate: "AAA111", Time: "2024-01-01T10:00:00Z", GarageId: "north"},
+		{Event: "entry", Plate: "AAA111", Time: "2024-01-01T11:00:00Z", GarageId: "south"},
+		{Event: "exit", Plate: "AAA111", Time: "2024-01-01T12:00:00Z", GarageId: "north"},
+	})
+	if len(paired) != 1 || paired[0].entry == nil || paired[0].entry.GarageId != "north" {
+		t.Errorf("Expected the exit from north paired with the entry into north, got %+v", paired)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"backend/billing"
+)
+
+var (
+	spoolDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "summary_spool_depth",
+		Help: "Summaries spooled in Redis and not yet delivered, per sink",
+	}, []string{"sink"})
+	circuitOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "summary_sink_circuit_open",
+		Help: "1 while the circuit breaker of a sink is open",
+	}, []string{"sink"})
+)
+
+func init() {
+	prometheus.MustRegister(spoolDepth)
+	prometheus.MustRegister(circuitOpen)
+}
+
+// Summary waiting in a sink's spool. StreamId is assigned by the spool.
+type spooledSummary struct {
+	StreamId       string          `json:"-"`
+	Summary        billing.Summary `json:"summary"`
+	IdempotencyKey string          `json:"idempotency_key"`
+	// W3C traceparent of the exit that produced the summary
+	TraceParent string    `json:"traceparent,omitempty"`
+	SpooledAt   time.Time `json:"spooled_at"`
+}
+
+type spoolStore interface {
+	spoolSummary(sinks []string, entry spooledSummary) error
+	heartbeat(consumer string, ttl time.Duration) error
+	readSpool(sink, consumer string, count int, block time.Duration) ([]spooledSummary, error)
+	claimStaleSpool(sink, consumer string, minIdle time.Duration, count int) ([]spooledSummary, error)
+	ackSpool(sink string, entry spooledSummary) error
+	deadLetterSpool(sink string, entry spooledSummary, reason string) error
+	spoolDepth(sink string) (int64, error)
+}
+
+// Stops delivery attempts to a sink after threshold consecutive failures. Once cooldown has
+// passed a single trial delivery is let through, closing the breaker on success and opening it
+// again on failure.
+type circuitBreaker struct {
+	// Guards the state below, which the health check reads
+	mutex sync.Mutex
+	sink  string
+	// Zero disables the breaker
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+// wait returns how long to wait before the next attempt is allowed
+func (b *circuitBreaker) wait(now time.Time) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return 0
+	}
+	return max(b.openUntil.Sub(now), 0)
+}
+
+func (b *circuitBreaker) success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.threshold > 0 && b.failures >= b.threshold {
+		log.Printf("Circuit breaker of sink %s closed", b.sink)
+		circuitOpen.WithLabelValues(b.sink).Set(0)
+	}
+	b.failures = 0
+}
+
+func (b *circuitBreaker) failure(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return
+	}
+	if b.failures == b.threshold {
+		log.Printf("Circuit breaker of sink %s opened after %d failures", b.sink, b.failures)
+		circuitOpen.WithLabelValues(b.sink).Set(1)
+	}
+	b.openUntil = now.Add(b.cooldown)
+}
+
+// isOpen reports whether deliveries are paused, including while a trial delivery is pending
+func (b *circuitBreaker) isOpen() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.threshold > 0 && b.failures >= b.threshold
+}
+
+// backoffDelay doubles the policy's backoff with every attempt up to maxBackoff, and picks a
+// random delay between half and all of it, so replicas do not retry in lockstep
+func backoffDelay(policy retryPolicy, attempt int) time.Duration {
+	delay := policy.backoff
+	for i := 1; i < attempt && (policy.maxBackoff <= 0 || delay < policy.maxBackoff); i++ {
+		delay *= 2
+	}
+	if policy.maxBackoff > 0 {
+		delay = min(delay, policy.maxBackoff)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Delivers one sink's spool in order, off the exit consumer. Summaries are read from the spool
+// into a bounded buffer, so a sink that is down only grows the spool in Redis.
+type sinkWorker struct {
+	name    string
+	sink    summarySink
+	retry   retryPolicy
+	breaker *circuitBreaker
+	store   spoolStore
+	// Identifies this replica in the spool's consumer group
+	consumer   string
+	bufferSize int
+	// Summaries read by a consumer that stopped and not acknowledged for this long are taken over
+	claimIdle time.Duration
+	sleep     func(time.Duration)
+
+	mutex sync.Mutex
+	// Stream ids read by this worker and not yet delivered
+	pending map[string]bool
+}
+
+func (w *sinkWorker) run() {
+	buffer := make(chan spooledSummary, w.bufferSize)
+	go w.fill(buffer)
+	for entry := range buffer {
+		w.deliver(entry)
+	}
+}
+
+func (w *sinkWorker) fill(buffer chan<- spooledSummary) {
+	lastClaim := time.Time{}
+	for {
+		entries := []spooledSummary{}
+		if time.Since(lastClaim) >= w.claimIdle/2 && len(buffer) == 0 {
+			claimed, err := w.store.claimStaleSpool(w.name, w.consumer, w.claimIdle, w.bufferSize)
+			if err != nil {
+				log.Println(err)
+			}
+			entries = append(entries, claimed...)
+			lastClaim = time.Now()
+		}
+
+		read, err := w.store.readSpool(w.name, w.consumer, w.bufferSize, 5*time.Second)
+		if err != nil {
+			log.Println(err)
+			time.Sleep(time.Second)
+		}
+		entries = append(entries, read...)
+
+		for _, entry := range entries {
+			if w.markPending(entry) {
+				buffer <- entry
+			}
+		}
+		w.updateGauge()
+	}
+}
+
+// markPending reports whether the entry is new to this worker, a claimed entry can be one this
+// worker is still retrying
+func (w *sinkWorker) markPending(entry spooledSummary) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.pending == nil {
+		w.pending = map[string]bool{}
+	}
+	if w.pending[entry.StreamId] {
+		return false
+	}
+	w.pending[entry.StreamId] = true
+	return true
+}
+
+func (w *sinkWorker) donePending(entry spooledSummary) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.pending, entry.StreamId)
+}
+
+// deliver retries the summary until the sink takes it, rejects it or the retry policy gives up
+func (w *sinkWorker) deliver(entry spooledSummary) {
+	defer w.donePending(entry)
+
+	for attempt := 1; ; attempt++ {
+		for wait := w.breaker.wait(time.Now()); wait > 0; wait = w.breaker.wait(time.Now()) {
+			w.sleep(wait)
+		}
+
+		ctx, span := w.startSpan(entry, attempt)
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		start := time.Now()
+		err := w.sink.deliver(ctx, entry.Summary, entry.IdempotencyKey)
+		sinkLatency.WithLabelValues(w.name).Observe(time.Since(start).Seconds())
+		cancel()
+		endSpan(span, err)
+
+		if err == nil {
+			w.breaker.success()
+			sinkDeliveries.WithLabelValues(w.name, "success").Inc()
+			if err := w.store.ackSpool(w.name, entry); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		log.Printf("Failed to deliver summary for %s to sink %s: %s", entry.Summary.Vehicle, w.name, err)
+
+		// The sink answered, retrying will not change its mind
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			w.breaker.success()
+			w.deadLetter(entry, err)
+			return
+		}
+		w.breaker.failure(time.Now())
+		if w.retry.maxAttempts > 0 && attempt >= w.retry.maxAttempts {
+			w.deadLetter(entry, err)
+			return
+		}
+		sinkDeliveries.WithLabelValues(w.name, "retry").Inc()
+		w.updateGauge()
+		w.sleep(backoffDelay(w.retry, attempt))
+	}
+}
+
+// startSpan continues the trace of the exit that produced the summary
+func (w *sinkWorker) startSpan(entry spooledSummary, attempt int) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier{"traceparent": entry.TraceParent})
+	return tracer.Start(ctx, "deliver summary to "+w.name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("sink", w.name), attribute.Int("attempt", attempt)))
+}
+
+func (w *sinkWorker) deadLetter(entry spooledSummary, reason error) {
+	sinkDeliveries.WithLabelValues(w.name, "dead").Inc()
+	if err := w.store.deadLetterSpool(w.name, entry, reason.Error()); err != nil {
+		log.Println(err)
+	}
+}
+
+func (w *sinkWorker) updateGauge() {
+	depth, err := w.store.spoolDepth(w.name)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	spoolDepth.WithLabelValues(w.name).Set(float64(depth))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const heldAtHeader = "x-held-at"
+
+// Returned by processExitEvent when the exit was parked instead of billed
+var errExitHeld = errors.New("exit held until its entry arrives")
+
+var exitHoldSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "exit_hold_seconds",
+	Help:    "Time unmatched exits spent parked before being re-evaluated",
+	Buckets: []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600},
+}, []string{"released_by", "garage"})
+
+var exitsHeld = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "exits_held_total",
+	Help: "Unmatched exits parked to wait for their entry, counted again in events_processed_total once re-evaluated",
+}, []string{"garage"})
+
+func init() {
+	prometheus.MustRegister(exitHoldSeconds)
+	prometheus.MustRegister(exitsHeld)
+}
+
+// Exit parked in Redis while waiting for its entry
+type heldExit struct {
+	Exit   exitEvent `json:"exit"`
+	HeldAt time.Time `json:"held_at"`
+	// Where it is parked, set when it is read back
+	key string
+}
+
+type holdStore interface {
+	holdExit(held heldExit, deadline time.Time) error
+	heldExitsFor(garage, vehiclePlate string) ([]heldExit, error)
+	removeHeldExit(held heldExit) error
+	claimExpiredHeldExits(now time.Time) ([]heldExit, error)
+	unclaimHeldExit(held heldExit, deadline time.Time) error
+}
+
+// Parks unmatched exits for up to window, since their entry can still be waiting in the other
+// queue. A parked exit goes back to the exit queue as soon as its entry is stored, or once the
+// window has passed, and is only then matched fuzzily or billed as unmatched.
+type exitHolder struct {
+	database  holdStore
+	publisher amqpPublisher
+	// Zero disables holding
+	window time.Duration
+}
+
+// shouldHold reports whether an unmatched exit first held at heldAt may still wait, a zero heldAt
+// means the exit has not been held yet
+func (h *exitHolder) shouldHold(heldAt, now time.Time) bool {
+	if h == nil || h.window <= 0 {
+		return false
+	}
+	return heldAt.IsZero() || now.Sub(heldAt) < h.window
+}
+
+func (h *exitHolder) hold(exit exitEvent, heldAt, now time.Time) error {
+	if heldAt.IsZero() {
+		heldAt = now
+	}
+	log.Printf("Holding exit of %s in garage %s for up to %s", exit.VehiclePlate, exit.GarageId, h.window)
+	return h.database.holdExit(heldExit{Exit: exit, HeldAt: heldAt}, heldAt.Add(h.window))
+}
+
+// releaseFor sends the exits held for the plate in the garage, if any, back to the exit queue.
+// Called once the plate's entry is stored.
+func (h *exitHolder) releaseFor(garage, vehiclePlate string) error {
+	if h == nil || h.window <= 0 {
+		return nil
+	}
+	exits, err := h.database.heldExitsFor(garage, vehiclePlate)
+	if err != nil {
+		return err
+	}
+
+	for _, held := range exits {
+		// Publish before removing, a duplicate is skipped by the exit consumer while a lost exit is not recoverable
+		err = h.requeue(held)
+		if err != nil {
+			return err
+		}
+		exitHoldSeconds.WithLabelValues("entry", garage).Observe(time.Since(held.HeldAt).Seconds())
+		err = h.database.removeHeldExit(held)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *exitHolder) run() {
+	ticker := time.NewTicker(max(h.window/10, time.Second))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.releaseExpired(time.Now())
+	}
+}
+
+// releaseExpired sends every exit whose window has passed back to the exit queue. Claiming an
+// exit removes it from the deadline index, so concurrent replicas release each one once.
+func (h *exitHolder) releaseExpired(now time.Time) {
+	expired, err := h.database.claimExpiredHeldExits(now)
+	if err != nil {
+		log.Println("Failed to claim expired held exits: ", err)
+	}
+	for _, held := range expired {
+		err := h.requeue(held)
+		if err != nil {
+			log.Println(err)
+			// Leave it for the next tick
+			if err := h.database.unclaimHeldExit(held, now); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		exitHoldSeconds.WithLabelValues("expiry", held.Exit.GarageId).Observe(now.Sub(held.HeldAt).Seconds())
+		if err := h.database.removeHeldExit(held); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (h *exitHolder) requeue(held heldExit) error {
+	body, err := json.Marshal(held.Exit)
+	if err != nil {
+		return fmt.Errorf("failed to marshal held exit: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = h.publisher.PublishWithContext(ctx,
+		"",            // exchange
+		exitQueueName, // routing key
+		false,         // mandatory
+		false,         // immediate
+		amqp.Publishing{
+			Headers:      amqp.Table{heldAtHeader: held.HeldAt.UTC().Format(time.RFC3339Nano)},
+			ContentType:  "text/plain",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		})
+	if err != nil {
+		return fmt.Errorf("failed to requeue held exit of %s: %w", held.Exit.VehiclePlate, err)
+	}
+	return nil
+}
+
+// heldSince returns when the delivered exit was first held, or the zero time if it never was
+func heldSince(d amqp.Delivery) time.Time {
+	value, ok := d.Headers[heldAtHeader].(string)
+	if !ok {
+		return time.Time{}
+	}
+	heldAt, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return heldAt
+}
@@ -1,27 +1,41 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"backend/billing"
+	"health"
 )
 
+// Garage of events without a garage_id, sent by simulators that only know a single garage
+const defaultGarage = "default"
+
 // Car registered at entrance toll
 // "id": <identifier for the event>,
 // "vehicle_plate": <alphanumeric registration id of the vehicle>,
-// "entry_date_time": <date time in UTC>
+// "entry_date_time": <date time in UTC>,
+// "garage_id", "gate_id", "lane_id": <where the camera is, optional>
 type entryEvent struct {
 	Id            string `json:"id"`
 	VehiclePlate  string `json:"vehicle_plate"`
 	EntryDateTime string `json:"entry_date_time"`
+	GarageId      string `json:"garage_id,omitempty"`
+	GateId        string `json:"gate_id,omitempty"`
+	LaneId        string `json:"lane_id,omitempty"`
 }
 
 // Car registered at exit toll
@@ -29,21 +43,35 @@ type entryEvent struct {
 //	"id": <identifier for the event>,
 //	"vehicle_plate": <alphanumeric registration id of the vehicle>,
 //	"exit_date_time": <date time in UTC>,
+//	"garage_id", "gate_id", "lane_id": <where the camera is, optional>
 type exitEvent struct {
 	Id           string `json:"id"`
 	VehiclePlate string `json:"vehicle_plate"`
 	ExitDateTime string `json:"exit_date_time"`
+	GarageId     string `json:"garage_id,omitempty"`
+	GateId       string `json:"gate_id,omitempty"`
+	LaneId       string `json:"lane_id,omitempty"`
 }
 
-type summary struct {
-	Vehicle   string `json:"vehicle"`
-	EntryTime string `json:"entryTime"`
-	ExitTime  string `json:"exitTime"`
+func garageOrDefault(garage string) string {
+	if garage == "" {
+		return defaultGarage
+	}
+	return garage
 }
 
 type databaser interface {
-	store(entryEvent)
-	get(string) (entryEvent, bool)
+	openSession(context.Context, entryEvent, time.Time) (session, error)
+	closeSession(context.Context, string, exitEvent) (session, bool, error)
+	openSessionPlates(ctx context.Context, garage string) ([]string, error)
+	currentSession(garage, vehiclePlate string) (session, bool, error)
+	claimEvent(ctx context.Context, kind, id string) (bool, error)
+	releaseEvent(ctx context.Context, kind, id string) error
+	openSessionCount(garage string) (int64, error)
+}
+
+type summaryQueuer interface {
+	enqueue(ctx context.Context, summary billing.Summary, idempotencyKey string) error
 }
 
 type httpClienter interface {
@@ -51,18 +79,32 @@ type httpClienter interface {
 }
 
 var (
-	postRequestLatency = prometheus.NewSummary(prometheus.SummaryOpts{
-		Name:       "post_request_latency_seconds",
-		Help:       "Latency of POST requests to the writer service in seconds",
-		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	postRequestLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "post_request_latency_seconds",
+		Help:    "Latency of POST requests to the writer service in seconds",
+		Buckets: prometheus.DefBuckets,
 	})
+	duplicateEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "duplicate_events_total",
+		Help: "Events skipped because an event with the same id was already processed",
+	}, []string{"event", "garage", "gate"})
+	plateMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "plate_matches_total",
+		Help: "Exit events by how their plate was matched to an entry",
+	}, []string{"match_type", "garage", "gate"})
 )
 
 func init() {
 	prometheus.MustRegister(postRequestLatency)
+	prometheus.MustRegister(plateMatches)
+	prometheus.MustRegister(duplicateEvents)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(health.RunHealthcheck("backend", os.Args[2:], os.Stderr))
+	}
+
 	rabbitmqHost := os.Getenv("RABBITMQ_HOST")
 	rabbitmqPort := os.Getenv("RABBITMQ_PORT")
 	if rabbitmqHost == "" || rabbitmqPort == "" {
@@ -70,13 +112,6 @@ func main() {
 	}
 	rabbitmqURL := fmt.Sprintf("amqp://guest:guest@%s:%s/", rabbitmqHost, rabbitmqPort)
 
-	writerHost := os.Getenv("WRITER_HOST")
-	writerPort := os.Getenv("WRITER_PORT")
-	if writerHost == "" || writerPort == "" {
-		log.Fatalf("WRITER_HOST and WRITER_PORT must be set")
-	}
-	writerURL := fmt.Sprintf("http://%s:%s/log", writerHost, writerPort)
-
 	redisHost := os.Getenv("REDIS_HOST")
 	redisPort := os.Getenv("REDIS_PORT")
 	if redisHost == "" || redisPort == "" {
@@ -84,83 +119,36 @@ func main() {
 	}
 	redisURL := fmt.Sprintf("%s:%s", redisHost, redisPort)
 
-	var conn *amqp.Connection
-	var err error
-	for i := 0; ; i++ {
-		conn, err = amqp.Dial(rabbitmqURL)
-		if err != nil {
-			fmt.Println("Failed to connect to RabbitMQ", err)
-		}
-
-		if conn != nil {
-			break
-		}
-		time.Sleep(1 * time.Second)
-
-		if i == 15*60 {
-			return
-		}
-
-	}
-	defer conn.Close()
-
-	ch, err := conn.Channel()
+	acceptLegacyTimestamps = getEnvBool("ACCEPT_LEGACY_TIMESTAMPS", true)
+	gates, err := parseGates(os.Getenv("GARAGE_GATES"))
 	if err != nil {
-		log.Fatalf("%s: %s", "Failed to open a channel", err)
+		log.Fatalln("Invalid GARAGE_GATES: ", err)
 	}
-	defer ch.Close()
+	metricGates = gates
 
-	entryQ, err := ch.QueueDeclare(
-		"entry-event", // name
-		false,         // durable
-		false,         // delete when unused
-		false,         // exclusive
-		false,         // no-wait
-		nil,           // arguments
-	)
+	shutdownTracing, err := setupTracing("backend")
 	if err != nil {
-		log.Fatalf("%s: %s", "Failed to declare entry queue", err)
+		log.Fatalln("Failed to set up tracing: ", err)
 	}
-
-	entryMsgs, err := ch.Consume(
-		entryQ.Name, // queue
-		"",          // consumer
-		true,        // auto-ack
-		false,       // exclusive
-		false,       // no-local
-		false,       // no-wait
-		nil,         // args
-	)
-	if err != nil {
-		log.Fatalf("%s: %s", "Failed to register a consumer", err)
+	defer shutdownTracing(context.Background())
+
+	rabbitmq := &rabbitmqConnection{
+		url:      rabbitmqURL,
+		prefetch: getEnvInt("PREFETCH_COUNT", 10),
+		retry: retryPolicy{
+			backoff:    time.Duration(getEnvInt("RABBITMQ_RECONNECT_BACKOFF_MS", 1000)) * time.Millisecond,
+			maxBackoff: time.Duration(getEnvInt("RABBITMQ_RECONNECT_MAX_BACKOFF_MS", 30000)) * time.Millisecond,
+		},
+		maxDowntime: time.Duration(getEnvInt("RABBITMQ_MAX_DOWNTIME_SECONDS", 15*60)) * time.Second,
 	}
-
-	exitQ, err := ch.QueueDeclare(
-		"exit-event", // name
-		false,        // durable
-		false,        // delete when unused
-		false,        // exclusive
-		false,        // no-wait
-		nil,          // arguments
-	)
-	if err != nil {
-		log.Fatalf("%s: %s", "Failed to declare exit queue", err)
+	rabbitmq.connect()
+	retry := retryPolicy{
+		maxAttempts: getEnvInt("MAX_DELIVERY_ATTEMPTS", 5),
+		backoff:     time.Duration(getEnvInt("RETRY_BACKOFF_MS", 1000)) * time.Millisecond,
+		maxBackoff:  time.Duration(getEnvInt("RETRY_MAX_BACKOFF_MS", 60000)) * time.Millisecond,
 	}
 
-	exitMsgs, err := ch.Consume(
-		exitQ.Name, // queue
-		"",         // consumer
-		true,       // auto-ack
-		false,      // exclusive
-		false,      // no-local
-		false,      // no-wait
-		nil,        // args
-	)
-	if err != nil {
-		log.Fatalf("%s: %s", "Failed to register exit consumer", err)
-	}
-
-	// Start prometheus server
+	// Start prometheus server, the health endpoints join it once the dependencies are set up
 	http.Handle("/metrics", promhttp.Handler())
 	prometheusMetricsPort := os.Getenv("PROMETHEUS_METRICS_PORT")
 	if prometheusMetricsPort == "" {
@@ -168,88 +156,415 @@ func main() {
 	}
 	go http.ListenAndServe(":"+prometheusMetricsPort, nil)
 
+	apiPort := os.Getenv("API_PORT")
+	if apiPort == "" {
+		log.Fatalf("API_PORT must be set")
+	}
+
 	httpClient := &http.Client{Timeout: 10 * time.Second}
 
+	tariffPath := os.Getenv("TARIFF_CONFIG")
+	if tariffPath == "" {
+		tariffPath = "config/tariff.json"
+	}
+	tariff, err := billing.LoadTariff(tariffPath)
+	if err != nil {
+		log.Fatalln("Failed to load tariff: ", err)
+	}
+	log.Printf("Using tariff %s (%s)", tariff.Version, tariff.Currency)
+
 	redis, err := retryCreateRedisClient(redisURL)
 	if err != nil {
 		log.Fatalln("Failed to connect to Redis: ", err)
 	}
-	database := &redisWrapper{client: redis}
+	redis.AddHook(redisTracingHook{})
+	redis.AddHook(redisMetricsHook{})
+	retention := time.Duration(getEnvInt("SESSION_RETENTION_DAYS", 30)) * 24 * time.Hour
+	database := &redisWrapper{
+		client:         redis,
+		retention:      retention,
+		eventRetention: time.Duration(getEnvInt("EVENT_RETENTION_HOURS", 72)) * time.Hour,
+	}
+	updateAllOccupancy(database)
+	if err := database.migrateHeldExits(); err != nil {
+		log.Println("Failed to migrate held exits: ", err)
+	}
+
+	matcher := &plateMatcher{
+		maxDistance:       getEnvFloat("FUZZY_MAX_DISTANCE", 2),
+		autoMatchDistance: getEnvFloat("FUZZY_AUTO_MATCH_DISTANCE", 1),
+		review:            rabbitmq,
+	}
+
+	sweeper := &orphanSweeper{
+		database:  database,
+		publisher: rabbitmq,
+		maxStay:   time.Duration(getEnvInt("MAX_STAY_HOURS", 72)) * time.Hour,
+		interval:  time.Duration(getEnvInt("SWEEP_INTERVAL_SECONDS", 60)) * time.Second,
+		token:     randomId(),
+	}
+
+	capacities, err := parseCapacities(os.Getenv("GARAGE_CAPACITIES"), getEnvInt("GARAGE_CAPACITY", 0))
+	if err != nil {
+		log.Fatalln("Invalid GARAGE_CAPACITIES: ", err)
+	}
+	api := &queryAPI{database: database, tariff: tariff, capacities: capacities, now: time.Now}
+	apiMux := http.NewServeMux()
+	api.register(apiMux)
+	go func() {
+		log.Fatalln("Query API stopped: ", http.ListenAndServe(":"+apiPort, apiMux))
+	}()
+
+	sinks, err := newSummaryFanout(httpClient, database, randomId())
+	if err != nil {
+		log.Fatalln("Failed to configure summary sinks: ", err)
+	}
+
+	holder := &exitHolder{
+		database:  database,
+		publisher: rabbitmq,
+		window:    time.Duration(getEnvInt("EXIT_HOLD_SECONDS", 60)) * time.Second,
+	}
 
-	go consumeEntryEvents(entryMsgs, database)
-	go consumeExitEvents(exitMsgs, database, httpClient, writerURL)
+	healthHandler := &health.Handler{
+		Live: rabbitmq.live,
+		Checks: append([]health.Check{
+			{Name: "amqp", Check: rabbitmq.ready},
+			{Name: "redis", Check: func(ctx context.Context) error {
+				return redis.Ping(ctx).Err()
+			}},
+		}, sinks.healthChecks()...),
+	}
+	healthHandler.Register(http.DefaultServeMux)
+
+	go rabbitmq.run([]rabbitmqConsumer{
+		{queue: entryQueueName, handle: func(deliveries <-chan amqp.Delivery) {
+			consumeEntryEvents(deliveries, rabbitmq, retry, database, holder)
+		}},
+		{queue: exitQueueName, handle: func(deliveries <-chan amqp.Delivery) {
+			consumeExitEvents(deliveries, rabbitmq, retry, database, tariff, matcher, holder, sinks)
+		}},
+	})
+	go sweeper.run()
+	sinks.run()
+	if holder.window > 0 {
+		go holder.run()
+	}
 
 	select {}
 }
 
-func consumeEntryEvents(delivery <-chan amqp.Delivery, database databaser) {
+func consumeEntryEvents(delivery <-chan amqp.Delivery, publisher amqpPublisher, retry retryPolicy, database databaser, holder *exitHolder) {
 	for d := range delivery {
-		entryEventFunc(d, database)
+		handleDelivery(d, func(d amqp.Delivery) error {
+			return entryEventFunc(d, database, holder)
+		}, publisher, retry)
 	}
 }
 
-func entryEventFunc(d amqp.Delivery, database databaser) {
+func entryEventFunc(d amqp.Delivery, database databaser, holder *exitHolder) (err error) {
 	log.Printf("Received evntry event: %s", d.Body)
+	ctx, span := startConsumerSpan(d, "process entry-event")
+	defer func() { endSpan(span, err) }()
 
 	entryEvent := entryEvent{}
-	err := json.Unmarshal(d.Body, &entryEvent)
+	err = json.Unmarshal(d.Body, &entryEvent)
+	if err != nil {
+		eventOutcomes.WithLabelValues("entry", outcomeMalformed, "", "").Inc()
+		return permanentError{fmt.Errorf("failed to unmarshal entry event: %w", err)}
+	}
+	entryEvent.GarageId = garageOrDefault(entryEvent.GarageId)
+	garage, gate := entryEvent.GarageId, gateLabel(entryEvent.GarageId, entryEvent.GateId)
+	entryTime, err := parseEventTime(entryEvent.EntryDateTime)
+	if err != nil {
+		eventOutcomes.WithLabelValues("entry", outcomeMalformed, garage, gate).Inc()
+		return permanentError{fmt.Errorf("invalid entry time: %w", err)}
+	}
+	entryEvent.EntryDateTime = formatEventTime(entryTime)
+	observeLag("entry", garage, gate, entryTime)
+
+	span.SetAttributes(
+		attribute.String("vehicle.plate", entryEvent.VehiclePlate),
+		attribute.String("garage.id", garage),
+		attribute.String("gate.id", entryEvent.GateId),
+	)
+
+	duplicate, err := skipDuplicate(ctx, database, "entry", entryEvent.Id, garage, gate)
+	if err != nil || duplicate {
+		return err
+	}
+	defer func() { releaseOnError(ctx, database, "entry", entryEvent.Id, err) }()
+
+	_, err = database.openSession(ctx, entryEvent, entryTime)
 	if err != nil {
-		log.Fatalf("Failed to unmarshal entry event: %s", err)
+		return err
 	}
+	eventOutcomes.WithLabelValues("entry", outcomeStored, garage, gate).Inc()
+	updateOccupancy(database, garage)
+	// The vehicle's exit may have overtaken this entry
+	return holder.releaseFor(garage, entryEvent.VehiclePlate)
+}
 
-	database.store(entryEvent)
+// skipDuplicate claims the event id and reports whether another delivery already holds it. Events
+// without an id cannot be deduplicated.
+func skipDuplicate(ctx context.Context, database databaser, kind, id, garage, gate string) (bool, error) {
+	if id == "" {
+		return false, nil
+	}
+	claimed, err := database.claimEvent(ctx, kind, id)
+	if err != nil {
+		return false, err
+	}
+	duplicate := !claimed
+	if duplicate {
+		log.Printf("Skipping duplicate %s event %s", kind, id)
+		duplicateEvents.WithLabelValues(kind, garage, gate).Inc()
+		eventOutcomes.WithLabelValues(kind, outcomeDuplicate, garage, gate).Inc()
+	}
+	return duplicate, nil
 }
 
-func consumeExitEvents(delivery <-chan amqp.Delivery, database databaser, httpClient *http.Client, writerURL string) {
+// releaseOnError gives up the claim on an event that failed, so its retry is not taken for a duplicate
+func releaseOnError(ctx context.Context, database databaser, kind, id string, err error) {
+	if err == nil || id == "" {
+		return
+	}
+	if releaseErr := database.releaseEvent(ctx, kind, id); releaseErr != nil {
+		log.Printf("Failed to release %s event %s: %v", kind, id, releaseErr)
+	}
+}
+
+func consumeExitEvents(delivery <-chan amqp.Delivery, publisher amqpPublisher, retry retryPolicy, database databaser, tariff *billing.Tariff, matcher *plateMatcher, holder *exitHolder, sinks summaryQueuer) {
 	for d := range delivery {
-		exitEventFunc(d, database, httpClient, writerURL)
+		handleDelivery(d, func(d amqp.Delivery) error {
+			return exitEventFunc(d, database, tariff, matcher, holder, sinks)
+		}, publisher, retry)
 	}
 }
 
-func exitEventFunc(d amqp.Delivery, database databaser, httpClient httpClienter, writerURL string) {
+func exitEventFunc(d amqp.Delivery, database databaser, tariff *billing.Tariff, matcher *plateMatcher, holder *exitHolder, sinks summaryQueuer) (err error) {
 	log.Printf("Received exit event: %s", d.Body)
-
 	exitEvent := exitEvent{}
-	err := json.Unmarshal(d.Body, &exitEvent)
+	start := time.Now()
+	defer func() {
+		exitProcessing.WithLabelValues(exitEvent.GarageId).Observe(time.Since(start).Seconds())
+	}()
+	ctx, span := startConsumerSpan(d, "process exit-event")
+	defer func() { endSpan(span, err) }()
+
+	err = json.Unmarshal(d.Body, &exitEvent)
 	if err != nil {
-		log.Fatalf("Failed to unmarshal exit event: %s", err)
+		eventOutcomes.WithLabelValues("exit", outcomeMalformed, "", "").Inc()
+		return permanentError{fmt.Errorf("failed to unmarshal exit event: %w", err)}
 	}
-
-	entryEvent, ok := database.get(exitEvent.VehiclePlate)
-	// We did not manage to register the car's entrance event. For now just give customer the minimum parking time
-	if !ok {
-		entryEvent.EntryDateTime = exitEvent.ExitDateTime
+	exitEvent.GarageId = garageOrDefault(exitEvent.GarageId)
+	garage, gate := exitEvent.GarageId, gateLabel(exitEvent.GarageId, exitEvent.GateId)
+	exitTime, err := parseEventTime(exitEvent.ExitDateTime)
+	if err != nil {
+		eventOutcomes.WithLabelValues("exit", outcomeMalformed, garage, gate).Inc()
+		return permanentError{fmt.Errorf("invalid exit time: %w", err)}
 	}
+	exitEvent.ExitDateTime = formatEventTime(exitTime)
+	observeLag("exit", garage, gate, exitTime)
+
+	span.SetAttributes(
+		attribute.String("vehicle.plate", exitEvent.VehiclePlate),
+		attribute.String("garage.id", garage),
+		attribute.String("gate.id", exitEvent.GateId),
+	)
 
-	summary := summary{
-		Vehicle:   exitEvent.VehiclePlate,
-		EntryTime: entryEvent.EntryDateTime,
-		ExitTime:  exitEvent.ExitDateTime,
+	duplicate, err := skipDuplicate(ctx, database, "exit", exitEvent.Id, garage, gate)
+	if err != nil || duplicate {
+		return err
+	}
+	defer func() { releaseOnError(ctx, database, "exit", exitEvent.Id, err) }()
+
+	err = processExitEvent(ctx, exitEvent, exitTime, heldSince(d), database, tariff, matcher, holder, sinks)
+	if errors.Is(err, errExitHeld) {
+		// Not processed yet, it comes back through the queue once released and claims its id again.
+		// Its outcome is counted then.
+		exitsHeld.WithLabelValues(garage).Inc()
+		return database.releaseEvent(ctx, "exit", exitEvent.Id)
 	}
-	summaryBytes, err := json.Marshal(summary)
 	if err != nil {
-		log.Fatalf("Failed to marshal summary: %s", err)
+		return err
 	}
+	updateOccupancy(database, garage)
+	return nil
+}
 
-	httpRequest, err := http.NewRequest("POST", writerURL, bytes.NewBuffer(summaryBytes))
+// closeSessionAt closes the plate's open session in the exit's garage unless it was entered after
+// the exit. The session is checked before it is closed, so an anomalous exit is dead-lettered
+// with the session untouched and a replay from the dead-letter queue finds it as it was.
+func closeSessionAt(ctx context.Context, database databaser, vehiclePlate string, exitEvent exitEvent, exitTime time.Time, gate string) (session, bool, error) {
+	current, ok, err := database.currentSession(exitEvent.GarageId, vehiclePlate)
 	if err != nil {
-		log.Fatalf("Failed to create HTTP request: %s", err)
+		return session{}, false, err
+	}
+	if ok {
+		entryTime, err := parseEventTime(current.EntryDateTime)
+		if err != nil {
+			return session{}, false, permanentError{fmt.Errorf("invalid entry time: %w", err)}
+		}
+		if err := checkExitTime(exitTime, entryTime, current, exitEvent.GarageId, gate); err != nil {
+			return session{}, false, err
+		}
+	}
+	return database.closeSession(ctx, vehiclePlate, exitEvent)
+}
+
+// checkExitTime rejects an exit earlier than the session's entry. Clock skew between the tolls or
+// two vehicles sharing a plate, nothing we can bill.
+func checkExitTime(exitTime, entryTime time.Time, session session, garage, gate string) error {
+	if !exitTime.Before(entryTime) {
+		return nil
+	}
+	timestampAnomalies.WithLabelValues(garage, gate).Inc()
+	eventOutcomes.WithLabelValues("exit", outcomeAnomaly, garage, gate).Inc()
+	return permanentError{fmt.Errorf("exit at %s is before entry at %s of session %s", formatEventTime(exitTime), formatEventTime(entryTime), session.Id)}
+}
+
+// processExitEvent closes the vehicle's session and queues its summary for the sinks. Only
+// sessions of the exit's garage are considered. An exit whose plate has no open session is held
+// while the holder allows it, heldAt is when it was first held, and only then matched fuzzily.
+func processExitEvent(ctx context.Context, exitEvent exitEvent, exitTime, heldAt time.Time, database databaser, tariff *billing.Tariff, matcher *plateMatcher, holder *exitHolder, sinks summaryQueuer) error {
+	garage, gate := exitEvent.GarageId, gateLabel(exitEvent.GarageId, exitEvent.GateId)
+	session, ok, err := closeSessionAt(ctx, database, exitEvent.VehiclePlate, exitEvent, exitTime, gate)
+	if err != nil {
+		return err
+	}
+	match := matchExact
+	score := 1.0
+
+	// No exact match, usually because the plate was misread at one of the tolls
+	if !ok {
+		// Or the entry is still on its way through the entry queue, fuzzy matching waits until the hold expires
+		if holder.shouldHold(heldAt, time.Now()) {
+			err = holder.hold(exitEvent, heldAt, time.Now())
+			if err != nil {
+				return err
+			}
+			return errExitHeld
+		}
+
+		openPlates, err := database.openSessionPlates(ctx, garage)
+		if err != nil {
+			return err
+		}
+		candidate, candidates, outcome := matcher.match(exitEvent.VehiclePlate, openPlates)
+		switch outcome {
+		case matchFuzzy:
+			session, ok, err = closeSessionAt(ctx, database, candidate.VehiclePlate, exitEvent, exitTime, gate)
+			if err != nil {
+				return err
+			}
+			match = matchFuzzy
+			score = matchScore(exitEvent.VehiclePlate, candidate.Distance)
+			if !ok {
+				match = matchUnmatched
+			}
+		case matchReview:
+			log.Printf("Sending exit of %s to review with %d candidate(s)", exitEvent.VehiclePlate, len(candidates))
+			err = matcher.sendToReview(exitEvent, candidates)
+			if err != nil {
+				return err
+			}
+			plateMatches.WithLabelValues(string(matchReview), garage, gate).Inc()
+			eventOutcomes.WithLabelValues("exit", outcomeReview, garage, gate).Inc()
+			return nil
+		default:
+			match = matchUnmatched
+		}
 	}
-	httpRequest.Header.Set("Content-Type", "application/json")
 
-	// Lazy retry
-	for i := 0; i < 15; i++ {
-		start := time.Now()
-		httpResponse, err := httpClient.Do(httpRequest)
-		duration := time.Since(start).Seconds()
-		postRequestLatency.Observe(duration)
+	plateMatches.WithLabelValues(string(match), garage, gate).Inc()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("match.type", string(match)))
 
+	// We did not manage to register the car's entrance event. Bill the minimum parking time plus the lost-entry fee
+	if !ok {
+		session.EntryDateTime = exitEvent.ExitDateTime
+		score = 0
+	}
+
+	summary := billing.Summary{
+		Vehicle:       exitEvent.VehiclePlate,
+		SessionId:     session.Id,
+		EntryTime:     session.EntryDateTime,
+		ExitTime:      exitEvent.ExitDateTime,
+		Currency:      tariff.Currency,
+		TariffVersion: tariff.Version,
+		MatchType:     string(match),
+		MatchScore:    score,
+		GarageId:      garage,
+		EntryGateId:   session.EntryGateId,
+		EntryLaneId:   session.EntryLaneId,
+		ExitGateId:    exitEvent.GateId,
+		ExitLaneId:    exitEvent.LaneId,
+	}
+	if match == matchFuzzy {
+		summary.MatchedPlate = session.VehiclePlate
+	}
+
+	if ok {
+		entryTime, err := parseEventTime(session.EntryDateTime)
 		if err != nil {
-			log.Println("Failed to send HTTP request: ", err)
+			return permanentError{fmt.Errorf("invalid entry time: %w", err)}
 		}
-		if httpResponse.StatusCode == http.StatusOK {
-			break
+		summary.EntryTime = formatEventTime(entryTime)
+
+		// The session can have changed between the check in closeSessionAt and closing it
+		if err := checkExitTime(exitTime, entryTime, session, garage, gate); err != nil {
+			return err
+		}
+		summary.DurationSeconds = int64(exitTime.Sub(entryTime).Seconds())
+		summary.Fee, err = tariff.Fee(entryTime, exitTime)
+		if err != nil {
+			return permanentError{err}
 		}
-		time.Sleep(1 * time.Second)
+	} else {
+		summary.Fee = tariff.LostEntryFee
+	}
+	eventOutcomes.WithLabelValues("exit", matchOutcome(match), garage, gate).Inc()
+	// The exit event id goes along as the idempotency key, so sinks can drop summaries they
+	// already have when a partly spooled exit is retried
+	return sinks.enqueue(ctx, summary, exitEvent.Id)
+}
+
+// getEnvBool reads an optional true/false setting, falling back to def when it is not set
+func getEnvBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("%s must be true or false: %s", name, err)
+	}
+	return parsed
+}
+
+// getEnvFloat reads an optional decimal setting, falling back to def when it is not set
+func getEnvFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("%s must be a number: %s", name, err)
+	}
+	return parsed
+}
+
+// getEnvInt reads an optional integer setting, falling back to def when it is not set
+func getEnvInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("%s must be an integer: %s", name, err)
 	}
+	return parsed
 }
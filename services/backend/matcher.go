@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"backend/billing"
+)
+
+type matchType string
+
+const (
+	matchExact     matchType = billing.MatchExact
+	matchFuzzy     matchType = billing.MatchFuzzy
+	matchReview    matchType = billing.MatchReview
+	matchUnmatched matchType = billing.MatchUnmatched
+)
+
+const reviewQueueName = "exit-review"
+
+// Substitution costs for characters cameras tend to mix up. Any other substitution,
+// insertion or deletion costs 1.
+var ocrConfusions = map[[2]byte]float64{
+	{'O', '0'}: 0.2, {'D', '0'}: 0.4, {'Q', '0'}: 0.4, {'O', 'D'}: 0.4, {'O', 'Q'}: 0.4,
+	{'I', '1'}: 0.2, {'L', '1'}: 0.4, {'I', 'L'}: 0.4, {'T', '1'}: 0.5,
+	{'B', '8'}: 0.3, {'S', '5'}: 0.3, {'Z', '2'}: 0.3, {'G', '6'}: 0.3,
+	{'A', '4'}: 0.5, {'T', '7'}: 0.5, {'B', '3'}: 0.5, {'E', 'F'}: 0.5,
+}
+
+func substitutionCost(a, b byte) float64 {
+	if a == b {
+		return 0
+	}
+	if cost, ok := ocrConfusions[[2]byte{a, b}]; ok {
+		return cost
+	}
+	if cost, ok := ocrConfusions[[2]byte{b, a}]; ok {
+		return cost
+	}
+	return 1
+}
+
+// plateDistance is the Levenshtein distance between two plates with substitutions weighted by ocrConfusions
+func plateDistance(a, b string) float64 {
+	previous := make([]float64, len(b)+1)
+	current := make([]float64, len(b)+1)
+	for j := range previous {
+		previous[j] = float64(j)
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = float64(i)
+		for j := 1; j <= len(b); j++ {
+			current[j] = min(
+				previous[j]+1,  // deletion
+				current[j-1]+1, // insertion
+				previous[j-1]+substitutionCost(a[i-1], b[j-1]),
+			)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+type plateCandidate struct {
+	VehiclePlate string  `json:"vehicle_plate"`
+	Distance     float64 `json:"distance"`
+}
+
+// Looks for the open session an unmatched exit most likely belongs to
+type plateMatcher struct {
+	// Candidates further away than this are ignored
+	maxDistance float64
+	// A candidate this close counts as strong and is matched without review
+	autoMatchDistance float64
+	review            amqpPublisher
+}
+
+// Published to the review queue when an exit cannot be matched automatically
+type reviewRequest struct {
+	Exit       exitEvent        `json:"exit"`
+	Candidates []plateCandidate `json:"candidates"`
+}
+
+// candidates returns the open plates within maxDistance of plate, closest first
+func (m *plateMatcher) candidates(plate string, openPlates []string) []plateCandidate {
+	candidates := []plateCandidate{}
+	for _, open := range openPlates {
+		distance := plateDistance(plate, open)
+		if distance <= m.maxDistance {
+			candidates = append(candidates, plateCandidate{open, distance})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Distance < candidates[j].Distance
+	})
+	return candidates
+}
+
+// match decides what to do with an exit plate that has no exact match. It returns the candidate
+// to close when exactly one strong candidate exists, matchReview when there are candidates but
+// none stands out, and matchUnmatched when nothing is close enough.
+func (m *plateMatcher) match(plate string, openPlates []string) (plateCandidate, []plateCandidate, matchType) {
+	candidates := m.candidates(plate, openPlates)
+	if len(candidates) == 0 {
+		return plateCandidate{}, candidates, matchUnmatched
+	}
+
+	strong := 0
+	for _, candidate := range candidates {
+		if candidate.Distance <= m.autoMatchDistance {
+			strong++
+		}
+	}
+	if strong == 1 {
+		return candidates[0], candidates, matchFuzzy
+	}
+	return plateCandidate{}, candidates, matchReview
+}
+
+func (m *plateMatcher) sendToReview(exit exitEvent, candidates []plateCandidate) error {
+	body, err := json.Marshal(reviewRequest{exit, candidates})
+	if err != nil {
+		return fmt.Errorf("failed to marshal review request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = m.review.PublishWithContext(ctx,
+		"",              // exchange
+		reviewQueueName, // routing key
+		false,           // mandatory
+		false,           // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		})
+	if err != nil {
+		return fmt.Errorf("failed to publish review request: %w", err)
+	}
+	return nil
+}
+
+// matchScore turns a distance into a similarity between 0 and 1
+func matchScore(plate string, distance float64) float64 {
+	if len(plate) == 0 {
+		return 0
+	}
+	return max(0, 1-distance/float64(len(plate)))
+}
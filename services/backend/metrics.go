@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// Outcomes counted in events_processed_total
+const (
+	outcomeStored       = "stored"
+	outcomeMatched      = "matched"
+	outcomeFuzzyMatched = "fuzzy_matched"
+	outcomeUnmatched    = "unmatched"
+	outcomeReview       = "review"
+	outcomeAnomaly      = "anomaly"
+	outcomeDuplicate    = "duplicate"
+	outcomeMalformed    = "malformed"
+)
+
+var (
+	eventLag = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "event_lag_seconds",
+		Help:    "Time from an event's timestamp until the backend consumed it",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"event", "garage", "gate"})
+	redisLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "redis_command_duration_seconds",
+		Help:    "Latency of Redis commands by command, pipelines are observed as a whole",
+		Buckets: []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	}, []string{"command"})
+	exitProcessing = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "exit_processing_seconds",
+		Help:    "Time to process one exit event, from receiving it until its summary is spooled",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"garage"})
+	eventOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "events_processed_total",
+		Help: "Consumed events by outcome",
+	}, []string{"event", "outcome", "garage", "gate"})
+	occupancy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "garage_occupancy",
+		Help: "Vehicles currently inside the garage, that is open sessions",
+	}, []string{"garage"})
+)
+
+func init() {
+	prometheus.MustRegister(eventLag)
+	prometheus.MustRegister(redisLatency)
+	prometheus.MustRegister(exitProcessing)
+	prometheus.MustRegister(eventOutcomes)
+	prometheus.MustRegister(occupancy)
+}
+
+// Label value of the gates not configured in GARAGE_GATES
+const otherGate = "other"
+
+// Gates of each garage that get a gate label value of their own. Gate ids come from the events,
+// so any other gate is counted as otherGate to keep the label bounded.
+var metricGates = map[string]map[string]bool{}
+
+// gateLabel returns the gate label value of a gate of the garage
+func gateLabel(garage, gate string) string {
+	if gate == "" || metricGates[garage][gate] {
+		return gate
+	}
+	return otherGate
+}
+
+// parseGates reads GARAGE_GATES, <garage>=<gate>|<gate> pairs separated by ","
+func parseGates(value string) (map[string]map[string]bool, error) {
+	gates := map[string]map[string]bool{}
+	if value == "" {
+		return gates, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		garage, ids, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || garage == "" || ids == "" {
+			return gates, fmt.Errorf("expected <garage>=<gate>|<gate>, got %q", pair)
+		}
+		gates[garage] = map[string]bool{}
+		for _, id := range strings.Split(ids, "|") {
+			gates[garage][id] = true
+		}
+	}
+	return gates, nil
+}
+
+// observeLag records how long ago the event happened, clock skew between the tolls and the
+// backend can make it negative
+func observeLag(event, garage, gate string, eventTime time.Time) {
+	eventLag.WithLabelValues(event, garage, gate).Observe(max(time.Since(eventTime).Seconds(), 0))
+}
+
+func matchOutcome(match matchType) string {
+	switch match {
+	case matchExact:
+		return outcomeMatched
+	case matchFuzzy:
+		return outcomeFuzzyMatched
+	default:
+		return outcomeUnmatched
+	}
+}
+
+func updateOccupancy(database databaser, garage string) {
+	count, err := database.openSessionCount(garage)
+	if err != nil {
+		log.Println("Failed to update occupancy: ", err)
+		return
+	}
+	occupancy.WithLabelValues(garage).Set(float64(count))
+}
+
+// updateAllOccupancy sets the occupancy of every garage known to Redis, done once at startup
+func updateAllOccupancy(database *redisWrapper) {
+	garages, err := database.garages()
+	if err != nil {
+		log.Println("Failed to update occupancy: ", err)
+		return
+	}
+	for _, garage := range garages {
+		updateOccupancy(database, garage)
+	}
+}
+
+// Observes the latency of every Redis command in redis_command_duration_seconds
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (redisMetricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		redisLatency.WithLabelValues(cmd.Name()).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func (redisMetricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		redisLatency.WithLabelValues("pipeline").Observe(time.Since(start).Seconds())
+		return err
+	}
+}
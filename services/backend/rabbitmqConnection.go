@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	rabbitmqConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rabbitmq_connected",
+		Help: "1 while the backend is connected to RabbitMQ",
+	})
+	rabbitmqReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rabbitmq_reconnects_total",
+		Help: "Reconnections to RabbitMQ after the connection or channel was lost",
+	})
+	rabbitmqDowntime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "rabbitmq_downtime_seconds",
+		Help:    "Time from losing the RabbitMQ connection until it was open again",
+		Buckets: []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(rabbitmqConnected)
+	prometheus.MustRegister(rabbitmqReconnects)
+	prometheus.MustRegister(rabbitmqDowntime)
+}
+
+// Consumes queue, handle returns once deliveries is closed
+type rabbitmqConsumer struct {
+	queue  string
+	handle func(deliveries <-chan amqp.Delivery)
+}
+
+// Keeps a RabbitMQ connection and channel open. When either closes it reconnects with backoff,
+// declares the topology again and restarts the consumers. Publishing goes through whichever
+// channel is currently open.
+type rabbitmqConnection struct {
+	url      string
+	prefetch int
+	// Only backoff and maxBackoff are used, reconnecting never gives up
+	retry retryPolicy
+	// Liveness fails once the broker has been unreachable for this long, zero disables it
+	maxDowntime time.Duration
+
+	mutex      sync.RWMutex
+	conn       *amqp.Connection
+	ch         *amqp.Channel
+	connClosed chan *amqp.Error
+	chClosed   chan *amqp.Error
+	// When the connection was lost, zero while connected
+	downSince time.Time
+}
+
+// connect dials until the broker is reachable and the topology is declared. The first
+// connection gives up after maxDowntime, as the process has nothing to do without it.
+func (c *rabbitmqConnection) connect() {
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := c.open()
+		if err == nil {
+			return
+		}
+		if c.first() && c.maxDowntime > 0 && time.Since(start) >= c.maxDowntime {
+			log.Fatalln("Failed to connect to RabbitMQ: ", err)
+		}
+		delay := backoffDelay(c.retry, attempt)
+		log.Printf("Failed to connect to RabbitMQ, retrying in %s: %s", delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// first reports whether the connection was never open before
+func (c *rabbitmqConnection) first() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.downSince.IsZero()
+}
+
+func (c *rabbitmqConnection) open() error {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to open a channel: %w", err)
+	}
+	err = declareTopology(ch)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to declare topology: %w", err)
+	}
+	// Publishes wait for the broker's confirm, so a message is only acked once its retry is safe
+	err = ch.Confirm(false)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	// Manual acks, so bound the number of unacknowledged messages held by this consumer
+	err = ch.Qos(c.prefetch, 0, false)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to set QoS: %w", err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn = conn
+	c.ch = ch
+	c.connClosed = conn.NotifyClose(make(chan *amqp.Error, 1))
+	c.chClosed = ch.NotifyClose(make(chan *amqp.Error, 1))
+	if !c.downSince.IsZero() {
+		log.Printf("Reconnected to RabbitMQ after %s", time.Since(c.downSince).Round(time.Millisecond))
+		rabbitmqReconnects.Inc()
+		rabbitmqDowntime.Observe(time.Since(c.downSince).Seconds())
+		c.downSince = time.Time{}
+	}
+	rabbitmqConnected.Set(1)
+	return nil
+}
+
+// run starts the consumers and starts them again on a new channel whenever the connection or
+// the channel is lost. It does not return.
+func (c *rabbitmqConnection) run(consumers []rabbitmqConsumer) {
+	for {
+		err := c.consume(consumers)
+		if err == nil {
+			err = c.waitClosed()
+		}
+		log.Println("Lost RabbitMQ connection, reconnecting: ", err)
+		c.lost()
+		c.connect()
+	}
+}
+
+func (c *rabbitmqConnection) consume(consumers []rabbitmqConsumer) error {
+	c.mutex.RLock()
+	ch := c.ch
+	c.mutex.RUnlock()
+
+	for _, consumer := range consumers {
+		deliveries, err := ch.Consume(
+			consumer.queue, // queue
+			"",             // consumer
+			false,          // auto-ack
+			false,          // exclusive
+			false,          // no-local
+			false,          // no-wait
+			nil,            // args
+		)
+		if err != nil {
+			return fmt.Errorf("failed to register a consumer for %s: %w", consumer.queue, err)
+		}
+		go consumer.handle(deliveries)
+	}
+	return nil
+}
+
+func (c *rabbitmqConnection) waitClosed() error {
+	c.mutex.RLock()
+	connClosed, chClosed := c.connClosed, c.chClosed
+	c.mutex.RUnlock()
+
+	var reason *amqp.Error
+	select {
+	case reason = <-connClosed:
+	case reason = <-chClosed:
+	}
+	// The notification channels are closed without a reason on a clean shutdown
+	if reason == nil {
+		return errors.New("connection closed")
+	}
+	return reason
+}
+
+// lost marks the connection down and closes what is left of it, which also closes the
+// consumers' delivery channels. Messages they had not acked yet are redelivered by the broker.
+func (c *rabbitmqConnection) lost() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = nil
+	c.ch = nil
+	c.downSince = time.Now()
+	rabbitmqConnected.Set(0)
+}
+
+// PublishWithContext publishes msg and waits until the broker confirmed it or ctx is done
+func (c *rabbitmqConnection) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.mutex.RLock()
+	ch := c.ch
+	c.mutex.RUnlock()
+
+	if ch == nil {
+		return errors.New("not connected to RabbitMQ")
+	}
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	if err != nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("no confirm from the broker: %w", err)
+	}
+	if !acked {
+		return errors.New("broker nacked the message")
+	}
+	return nil
+}
+
+// ready fails while the connection is being reestablished
+func (c *rabbitmqConnection) ready(ctx context.Context) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	switch {
+	case !c.downSince.IsZero():
+		return fmt.Errorf("reconnecting since %s", c.downSince.UTC().Format(time.RFC3339))
+	case c.conn == nil || c.conn.IsClosed():
+		return errors.New("connection closed")
+	case c.ch == nil || c.ch.IsClosed():
+		return errors.New("channel closed")
+	}
+	return nil
+}
+
+// live fails once the broker has been unreachable for longer than maxDowntime
+func (c *rabbitmqConnection) live() error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.maxDowntime > 0 && !c.downSince.IsZero() && time.Since(c.downSince) > c.maxDowntime {
+		return fmt.Errorf("RabbitMQ unreachable since %s", c.downSince.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
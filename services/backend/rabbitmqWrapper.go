@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	entryQueueName     = "entry-event"
+	exitQueueName      = "exit-event"
+	deadLetterExchange = "parking-dlx"
+
+	retryCountHeader     = "x-retry-count"
+	failureReasonHeader  = "x-failure-reason"
+	originalQueueHeader  = "x-original-queue"
+	failureTimeHeader    = "x-failed-at"
+	deadLetterQueueAffix = ".dead"
+	retryQueueAffix      = ".retry"
+)
+
+// permanentError marks a failure that retrying cannot fix, such as a malformed payload.
+// Messages failing with it are dead-lettered straight away.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+type amqpPublisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// queueArgs are shared with the simulator, both sides must declare the queues identically
+func queueArgs() amqp.Table {
+	return amqp.Table{"x-dead-letter-exchange": deadLetterExchange}
+}
+
+// retryQueueArgs send messages whose TTL ran out in the retry queue back to the event queue
+func retryQueueArgs(name string) amqp.Table {
+	return amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": name,
+	}
+}
+
+// declareTopology declares the durable event queues together with the dead-letter exchange,
+// one retry and one parking queue per event queue and the outgoing review and orphaned-session queues.
+func declareTopology(ch *amqp.Channel) error {
+	err := ch.ExchangeDeclare(
+		deadLetterExchange, // name
+		"direct",           // kind
+		true,               // durable
+		false,              // delete when unused
+		false,              // internal
+		false,              // no-wait
+		nil,                // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare dead-letter exchange: %w", err)
+	}
+
+	for _, name := range []string{entryQueueName, exitQueueName} {
+		_, err = ch.QueueDeclare(
+			name,        // name
+			true,        // durable
+			false,       // delete when unused
+			false,       // exclusive
+			false,       // no-wait
+			queueArgs(), // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare queue %s: %w", name, err)
+		}
+
+		// Retries wait here for their TTL before going back to the event queue. The broker only
+		// expires the message at the head, so a retry can wait for one with a longer delay ahead of it.
+		retryName := name + retryQueueAffix
+		_, err = ch.QueueDeclare(
+			retryName,            // name
+			true,                 // durable
+			false,                // delete when unused
+			false,                // exclusive
+			false,                // no-wait
+			retryQueueArgs(name), // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare queue %s: %w", retryName, err)
+		}
+
+		deadName := name + deadLetterQueueAffix
+		_, err = ch.QueueDeclare(
+			deadName, // name
+			true,     // durable
+			false,    // delete when unused
+			false,    // exclusive
+			false,    // no-wait
+			nil,      // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare queue %s: %w", deadName, err)
+		}
+
+		// Dead-lettered messages keep their original routing key, which is the queue name
+		err = ch.QueueBind(deadName, name, deadLetterExchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("failed to bind queue %s: %w", deadName, err)
+		}
+	}
+
+	// Queues the backend only publishes to: exits the fuzzy matcher could not settle and
+	// sessions flagged by the orphan sweeper
+	for _, name := range []string{reviewQueueName, orphanedQueueName} {
+		_, err = ch.QueueDeclare(
+			name,  // name
+			true,  // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			nil,   // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare queue %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// handleDelivery runs handler on d and settles the message. Successful messages are acked.
+// Failed ones are republished to the retry queue with an incremented retry count and a growing
+// delay until retry.maxAttempts is reached, after which they are parked on the dead-letter
+// exchange with the failure reason in the headers. The original is only acked once the broker
+// confirmed the republished message.
+func handleDelivery(d amqp.Delivery, handler func(amqp.Delivery) error, publisher amqpPublisher, retry retryPolicy) {
+	err := handler(d)
+	if err == nil {
+		if err := d.Ack(false); err != nil {
+			log.Println("Failed to ack message: ", err)
+		}
+		return
+	}
+
+	attempts := retryCount(d) + 1
+	var permanent permanentError
+	if errors.As(err, &permanent) || attempts >= retry.maxAttempts {
+		log.Printf("Dead-lettering message from %s after %d attempt(s): %s", d.RoutingKey, attempts, err)
+		deadLetter(d, publisher, err, attempts)
+		return
+	}
+
+	delay := backoffDelay(retry, attempts)
+	log.Printf("Retrying message from %s in %s (attempt %d of %d): %s", d.RoutingKey, delay, attempts, retry.maxAttempts, err)
+	headers := copyHeaders(d.Headers)
+	headers[retryCountHeader] = int32(attempts)
+	if err := republish(d, publisher, "", d.RoutingKey+retryQueueAffix, headers, delay); err != nil {
+		log.Println("Failed to republish message for retry: ", err)
+		if err := d.Nack(false, true); err != nil {
+			log.Println("Failed to nack message: ", err)
+		}
+		return
+	}
+	if err := d.Ack(false); err != nil {
+		log.Println("Failed to ack message: ", err)
+	}
+}
+
+func deadLetter(d amqp.Delivery, publisher amqpPublisher, cause error, attempts int) {
+	headers := copyHeaders(d.Headers)
+	headers[retryCountHeader] = int32(attempts)
+	headers[failureReasonHeader] = cause.Error()
+	headers[originalQueueHeader] = d.RoutingKey
+	headers[failureTimeHeader] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	if err := republish(d, publisher, deadLetterExchange, d.RoutingKey, headers, 0); err != nil {
+		// Fall back to the broker, which dead-letters rejected messages through the queue arguments
+		log.Println("Failed to publish to dead-letter exchange: ", err)
+		if err := d.Nack(false, false); err != nil {
+			log.Println("Failed to nack message: ", err)
+		}
+		return
+	}
+	if err := d.Ack(false); err != nil {
+		log.Println("Failed to ack message: ", err)
+	}
+}
+
+// republish publishes a copy of d, a non-zero ttl expires it after that long
+func republish(d amqp.Delivery, publisher amqpPublisher, exchange, key string, headers amqp.Table, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var expiration string
+	if ttl > 0 {
+		expiration = strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)
+	}
+
+	return publisher.PublishWithContext(ctx,
+		exchange, // exchange
+		key,      // routing key
+		false,    // mandatory
+		false,    // immediate
+		amqp.Publishing{
+			Headers:      headers,
+			ContentType:  d.ContentType,
+			DeliveryMode: amqp.Persistent,
+			Expiration:   expiration,
+			MessageId:    d.MessageId,
+			Timestamp:    d.Timestamp,
+			Body:         d.Body,
+		})
+}
+
+func retryCount(d amqp.Delivery) int {
+	switch v := d.Headers[retryCountHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+func copyHeaders(headers amqp.Table) amqp.Table {
+	copied := amqp.Table{}
+	for k, v := range headers {
+		copied[k] = v
+	}
+	return copied
+}
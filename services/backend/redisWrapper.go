@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -12,31 +16,849 @@ import (
 
 type redisWrapper struct {
 	client *redis.Client
+	// How long closed sessions are kept for the per-plate history
+	retention time.Duration
+	// How long processed event ids are remembered for deduplication
+	eventRetention time.Duration
 }
 
-func (r *redisWrapper) store(entry entryEvent) {
+type sessionState string
+
+const (
+	sessionOpen   sessionState = "OPEN"
+	sessionClosed sessionState = "CLOSED"
+	// The vehicle never left within the maximum stay
+	sessionOrphaned sessionState = "ORPHANED"
+	// A second entry was recorded for the plate while this session was still open
+	sessionDisputed sessionState = "DISPUTED"
+)
+
+// Parking session stored as a Redis hash under sessionKey(Id)
+type session struct {
+	Id            string       `json:"id" redis:"id"`
+	VehiclePlate  string       `json:"vehicle_plate" redis:"vehicle_plate"`
+	State         sessionState `json:"state" redis:"state"`
+	EntryEventId  string       `json:"entry_event_id" redis:"entry_event_id"`
+	EntryDateTime string       `json:"entry_date_time" redis:"entry_date_time"`
+	ExitEventId   string       `json:"exit_event_id,omitempty" redis:"exit_event_id"`
+	ExitDateTime  string       `json:"exit_date_time,omitempty" redis:"exit_date_time"`
+	GarageId      string       `json:"garage_id" redis:"garage_id"`
+	EntryGateId   string       `json:"entry_gate_id,omitempty" redis:"entry_gate_id"`
+	EntryLaneId   string       `json:"entry_lane_id,omitempty" redis:"entry_lane_id"`
+	ExitGateId    string       `json:"exit_gate_id,omitempty" redis:"exit_gate_id"`
+	ExitLaneId    string       `json:"exit_lane_id,omitempty" redis:"exit_lane_id"`
+}
+
+// Key layout:
+//
+//	session:<id>                  hash with the session fields
+//	garages                       set of the ids of all garages that recorded an entry
+//	<garage>plate:<plate>:open    id of the plate's open session in the garage
+//	<garage>plate:<plate>:history sorted set of the plate's session ids in the garage scored by entry time
+//	<garage>sessions:open         sorted set of the garage's open session ids scored by entry time
+//	<garage>sessions:orphaned     sorted set of the garage's orphaned session ids scored by the time they were flagged
+//	<garage>held:<exit id>        exit parked while waiting for its vehicle's entry
+//	<garage>plate:<plate>:held    sorted set of the keys of the plate's held exits scored by the time they were held
+//	exits:held                    sorted set of the keys of all held exits scored by the hold deadline
+//	lock:<name>                   token of the replica holding a lock
+//	processed:<kind>:<id>         marker for an entry or exit event that was already processed
+//	spool:<sink>                  stream of summaries waiting for delivery to a sink, read by a consumer group
+//	spool:<sink>:dead             stream of summaries the sink gave up on
+//	consumer:<consumer>           heartbeat of a replica reading the spools, expires once it stops
+//
+// <garage> is "garage:<id>:", except for the default garage, which keeps the keys it had before
+// there were several garages.
+const (
+	sessionKeyPrefix = "session:"
+	garagesKey       = "garages"
+	heldExitsKey     = "exits:held"
+	spoolGroup       = "delivery"
+)
+
+func sessionKey(id string) string {
+	return sessionKeyPrefix + id
+}
+
+func garageKey(garage, key string) string {
+	if garage == "" || garage == defaultGarage {
+		return key
+	}
+	return "garage:" + garage + ":" + key
+}
+
+func openSessionKey(garage, vehiclePlate string) string {
+	return garageKey(garage, "plate:"+vehiclePlate+":open")
+}
+
+func historyKey(garage, vehiclePlate string) string {
+	return garageKey(garage, "plate:"+vehiclePlate+":history")
+}
+
+func openSessionsKey(garage string) string {
+	return garageKey(garage, "sessions:open")
+}
+
+func orphanedSessionsKey(garage string) string {
+	return garageKey(garage, "sessions:orphaned")
+}
+
+// Opens a session and points the plate at it. A session the plate still had open is marked
+// DISPUTED. A session that already exists or is in the plate's history is left alone, it is being
+// opened again by a redelivered entry event and may have been closed since.
+//
+// KEYS: plate open key, plate history key, open sessions key, new session key, orphaned sessions key,
+// garages key
+// ARGV: session key prefix, session id, entry time score, history cutoff score, retention in seconds,
+// garage id, field/value pairs
+var openSessionScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[4]) == 1 or redis.call('ZSCORE', KEYS[2], ARGV[2]) then
+	return false
+end
+local previous = redis.call('GET', KEYS[1])
+if previous then
+	redis.call('HSET', ARGV[1] .. previous, 'state', 'DISPUTED')
+	redis.call('EXPIRE', ARGV[1] .. previous, ARGV[5])
+	redis.call('ZREM', KEYS[3], previous)
+	redis.call('ZREM', KEYS[5], previous)
+else
+	previous = false
+end
+redis.call('HSET', KEYS[4], unpack(ARGV, 7))
+redis.call('SADD', KEYS[6], ARGV[6])
+redis.call('SET', KEYS[1], ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', '(' .. ARGV[4])
+redis.call('ZADD', KEYS[3], ARGV[3], ARGV[2])
+return previous
+`)
+
+// Closes the plate's open session and starts its retention countdown. An orphaned session is
+// closed the same way, the vehicle turned out to leave after all. When the plate has no open
+// session but its latest one was closed by this very exit event, that one is returned, so a
+// redelivered exit is billed the same way again.
+//
+// KEYS: plate open key, open sessions key, plate history key, orphaned sessions key
+// ARGV: session key prefix, exit event id, exit time, retention in seconds, exit gate id, exit lane id
+var closeSessionScript = redis.NewScript(`
+local id = redis.call('GET', KEYS[1])
+if id and redis.call('EXISTS', ARGV[1] .. id) == 0 then
+	-- The session expired while orphaned
+	redis.call('DEL', KEYS[1])
+	id = false
+end
+if not id then
+	local latest = redis.call('ZRANGE', KEYS[3], -1, -1)[1]
+	if latest and redis.call('HGET', ARGV[1] .. latest, 'exit_event_id') == ARGV[2] then
+		return latest
+	end
+	return false
+end
+local key = ARGV[1] .. id
+redis.call('HSET', key, 'state', 'CLOSED', 'exit_event_id', ARGV[2], 'exit_date_time', ARGV[3],
+	'exit_gate_id', ARGV[5], 'exit_lane_id', ARGV[6])
+redis.call('EXPIRE', key, ARGV[4])
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[2], id)
+redis.call('ZREM', KEYS[4], id)
+return id
+`)
+
+// Flags an open session as orphaned. The plate keeps pointing at it, so a late exit still closes it.
+//
+// KEYS: open sessions key, orphaned sessions key
+// ARGV: session key prefix, session id, retention in seconds, flagged time score
+var orphanSessionScript = redis.NewScript(`
+local key = ARGV[1] .. ARGV[2]
+redis.call('ZREM', KEYS[1], ARGV[2])
+if redis.call('HGET', key, 'state') ~= 'OPEN' then
+	return false
+end
+redis.call('HSET', key, 'state', 'ORPHANED')
+redis.call('EXPIRE', key, ARGV[3])
+redis.call('ZADD', KEYS[2], ARGV[4], ARGV[2])
+return 1
+`)
+
+// Deletes a lock only if it is still held with the given token
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func (r *redisWrapper) openSession(ctx context.Context, entry entryEvent, entryTime time.Time) (session, error) {
+	s := session{
+		Id:            entry.Id,
+		VehiclePlate:  entry.VehiclePlate,
+		State:         sessionOpen,
+		EntryEventId:  entry.Id,
+		EntryDateTime: entry.EntryDateTime,
+		GarageId:      entry.GarageId,
+		EntryGateId:   entry.GateId,
+		EntryLaneId:   entry.LaneId,
+	}
+	if s.Id == "" {
+		s.Id = randomId()
+	}
+
+	cutoff := entryTime.Add(-r.retention)
+	args := []interface{}{sessionKeyPrefix, s.Id, entryTime.Unix(), cutoff.Unix(), int64(r.retention.Seconds()), s.GarageId,
+		"id", s.Id,
+		"vehicle_plate", s.VehiclePlate,
+		"state", string(s.State),
+		"entry_event_id", s.EntryEventId,
+		"entry_date_time", s.EntryDateTime,
+		"garage_id", s.GarageId,
+		"entry_gate_id", s.EntryGateId,
+		"entry_lane_id", s.EntryLaneId,
+	}
+	keys := []string{
+		openSessionKey(s.GarageId, s.VehiclePlate), historyKey(s.GarageId, s.VehiclePlate),
+		openSessionsKey(s.GarageId), sessionKey(s.Id), orphanedSessionsKey(s.GarageId), garagesKey,
+	}
+
+	previous, err := openSessionScript.Run(ctx, r.client, keys, args...).Text()
+	if err != nil && err != redis.Nil {
+		return s, fmt.Errorf("failed to open session: %w", err)
+	}
+	if previous != "" {
+		log.Printf("Session %s of %s disputed by a second entry in garage %s", previous, s.VehiclePlate, s.GarageId)
+	}
+	return s, nil
+}
+
+// closeSession closes the open session of vehiclePlate in the exit's garage with exit, which can
+// carry a different plate when it was matched fuzzily.
+func (r *redisWrapper) closeSession(ctx context.Context, vehiclePlate string, exit exitEvent) (session, bool, error) {
+	garage := exit.GarageId
+	keys := []string{openSessionKey(garage, vehiclePlate), openSessionsKey(garage), historyKey(garage, vehiclePlate), orphanedSessionsKey(garage)}
+	args := []interface{}{sessionKeyPrefix, exit.Id, exit.ExitDateTime, int64(r.retention.Seconds()), exit.GateId, exit.LaneId}
+
+	id, err := closeSessionScript.Run(ctx, r.client, keys, args...).Text()
+	if err == redis.Nil {
+		return session{}, false, nil
+	}
+	if err != nil {
+		return session{}, false, fmt.Errorf("failed to close session: %w", err)
+	}
+
+	s, ok, err := r.getSession(ctx, id)
+	if err != nil {
+		return s, false, err
+	}
+	return s, ok, nil
+}
+
+func (r *redisWrapper) getSession(ctx context.Context, id string) (session, bool, error) {
+	s := session{}
+	cmd := r.client.HGetAll(ctx, sessionKey(id))
+	if cmd.Err() != nil {
+		return s, false, fmt.Errorf("failed to get session: %w", cmd.Err())
+	}
+	if len(cmd.Val()) == 0 {
+		return s, false, nil
+	}
+	err := cmd.Scan(&s)
+	if err != nil {
+		return s, false, fmt.Errorf("failed to read session: %w", err)
+	}
+	return s, true, nil
+}
+
+// openSessionPlates returns the plates of all open sessions in the garage
+func (r *redisWrapper) openSessionPlates(ctx context.Context, garage string) ([]string, error) {
+	ids, err := r.client.ZRange(ctx, openSessionsKey(garage), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list open sessions: %w", err)
+	}
+
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGet(ctx, sessionKey(id), "vehicle_plate")
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get open session plates: %w", err)
+	}
+
+	plates := []string{}
+	for _, cmd := range cmds {
+		if cmd.Err() == nil {
+			plates = append(plates, cmd.Val())
+		}
+	}
+	return plates, nil
+}
+
+// garages returns the ids of all garages that recorded an entry
+func (r *redisWrapper) garages() ([]string, error) {
+	ctx := context.Background()
+	garages, err := r.client.SMembers(ctx, garagesKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list garages: %w", err)
+	}
+	sort.Strings(garages)
+	return garages, nil
+}
+
+// orphanSessions flags every session opened before cutoff in any garage as orphaned and returns
+// the ones it flagged
+func (r *redisWrapper) orphanSessions(cutoff time.Time) ([]session, error) {
+	garages, err := r.garages()
+	if err != nil {
+		return nil, err
+	}
+	orphaned := []session{}
+	for _, garage := range garages {
+		flagged, err := r.orphanGarageSessions(garage, cutoff)
+		orphaned = append(orphaned, flagged...)
+		if err != nil {
+			return orphaned, err
+		}
+	}
+	return orphaned, nil
+}
+
+func (r *redisWrapper) orphanGarageSessions(garage string, cutoff time.Time) ([]session, error) {
+	ctx := context.Background()
+	// Sessions flagged longer ago than the retention have expired
+	expired := time.Now().Add(-r.retention).Unix()
+	err := r.client.ZRemRangeByScore(ctx, orphanedSessionsKey(garage), "-inf", fmt.Sprintf("(%d", expired)).Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to trim orphaned sessions: %w", err)
+	}
+
+	ids, err := r.client.ZRangeByScore(ctx, openSessionsKey(garage), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: fmt.Sprint(cutoff.Unix()),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stale sessions: %w", err)
+	}
+
+	orphaned := []session{}
+	now := time.Now().Unix()
+	for _, id := range ids {
+		keys := []string{openSessionsKey(garage), orphanedSessionsKey(garage)}
+		args := []interface{}{sessionKeyPrefix, id, int64(r.retention.Seconds()), now}
+		err := orphanSessionScript.Run(ctx, r.client, keys, args...).Err()
+		if err == redis.Nil {
+			// Closed or disputed in the meantime
+			continue
+		}
+		if err != nil {
+			return orphaned, fmt.Errorf("failed to orphan session %s: %w", id, err)
+		}
+
+		s, ok, err := r.getSession(ctx, id)
+		if err != nil {
+			return orphaned, err
+		}
+		if ok {
+			orphaned = append(orphaned, s)
+		}
+	}
+	return orphaned, nil
+}
+
+// orphanedSessionCount returns how many sessions of the garage are currently flagged as orphaned.
+// Entries past the retention are not counted, their sessions have expired and the sweeper drops them.
+func (r *redisWrapper) orphanedSessionCount(garage string) (int64, error) {
+	ctx := context.Background()
+	cutoff := time.Now().Add(-r.retention).Unix()
+	count, err := r.client.ZCount(ctx, orphanedSessionsKey(garage), fmt.Sprint(cutoff), "+inf").Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count orphaned sessions: %w", err)
+	}
+	return count, nil
+}
+
+// claimEvent marks the event as processed unless it already is, in one SET NX so concurrent
+// deliveries of the same event cannot both claim it
+func (r *redisWrapper) claimEvent(ctx context.Context, kind, id string) (bool, error) {
+	claimed, err := r.client.SetNX(ctx, processedKey(kind, id), time.Now().UTC().Format(time.RFC3339), r.eventRetention).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim event: %w", err)
+	}
+	return claimed, nil
+}
+
+func (r *redisWrapper) releaseEvent(ctx context.Context, kind, id string) error {
+	err := r.client.Del(ctx, processedKey(kind, id)).Err()
+	if err != nil {
+		return fmt.Errorf("failed to release event: %w", err)
+	}
+	return nil
+}
+
+func processedKey(kind, id string) string {
+	return "processed:" + kind + ":" + id
+}
+
+func heldExitKey(garage, exitId string) string {
+	return garageKey(garage, "held:"+exitId)
+}
+
+func plateHeldExitsKey(garage, vehiclePlate string) string {
+	return garageKey(garage, "plate:"+vehiclePlate+":held")
+}
+
+// holdExit parks the exit under its event id, so several exits held for one plate each keep their
+// own entry. An exit without an id gets one.
+func (r *redisWrapper) holdExit(held heldExit, deadline time.Time) error {
+	ctx := context.Background()
+	if held.Exit.Id == "" {
+		held.Exit.Id = randomId()
+	}
+	bytes, err := json.Marshal(held)
+	if err != nil {
+		return fmt.Errorf("failed to marshal held exit: %w", err)
+	}
+
+	key := heldExitKey(held.Exit.GarageId, held.Exit.Id)
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, bytes, 0)
+		pipe.ZAdd(ctx, heldExitsKey, redis.Z{Score: float64(deadline.Unix()), Member: key})
+		pipe.ZAdd(ctx, plateHeldExitsKey(held.Exit.GarageId, held.Exit.VehiclePlate), redis.Z{Score: float64(held.HeldAt.Unix()), Member: key})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to hold exit: %w", err)
+	}
+	return nil
+}
+
+// heldExitsFor returns the exits held for the plate in the garage, oldest first
+func (r *redisWrapper) heldExitsFor(garage, vehiclePlate string) ([]heldExit, error) {
+	ctx := context.Background()
+	keys, err := r.client.ZRange(ctx, plateHeldExitsKey(garage, vehiclePlate), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list held exits: %w", err)
+	}
+
+	exits := []heldExit{}
+	for _, key := range keys {
+		held, ok, err := r.heldExitAt(key)
+		if err != nil {
+			return exits, err
+		}
+		if ok {
+			exits = append(exits, held)
+		}
+	}
+	return exits, nil
+}
+
+func (r *redisWrapper) heldExitAt(key string) (heldExit, bool, error) {
+	ctx := context.Background()
+	held := heldExit{}
+	val, err := r.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return held, false, nil
+	}
+	if err != nil {
+		return held, false, fmt.Errorf("failed to get held exit: %w", err)
+	}
+	err = json.Unmarshal([]byte(val), &held)
+	if err != nil {
+		return held, false, fmt.Errorf("failed to unmarshal held exit: %w", err)
+	}
+	held.key = key
+	return held, true, nil
+}
+
+func (r *redisWrapper) removeHeldExit(held heldExit) error {
+	ctx := context.Background()
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, held.key)
+		pipe.ZRem(ctx, heldExitsKey, held.key)
+		pipe.ZRem(ctx, plateHeldExitsKey(held.Exit.GarageId, held.Exit.VehiclePlate), held.key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to remove held exit: %w", err)
+	}
+	return nil
+}
+
+// claimExpiredHeldExits takes the exits whose deadline has passed out of the deadline index.
+// Only the caller whose ZREM succeeds gets an exit, so each is claimed once.
+func (r *redisWrapper) claimExpiredHeldExits(now time.Time) ([]heldExit, error) {
+	ctx := context.Background()
+	keys, err := r.client.ZRangeByScore(ctx, heldExitsKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: fmt.Sprint(now.Unix()),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list expired held exits: %w", err)
+	}
+
+	claimed := []heldExit{}
+	for _, key := range keys {
+		removed, err := r.client.ZRem(ctx, heldExitsKey, key).Result()
+		if err != nil {
+			return claimed, fmt.Errorf("failed to claim held exit: %w", err)
+		}
+		if removed == 0 {
+			continue
+		}
+		held, ok, err := r.heldExitAt(key)
+		if err != nil {
+			return claimed, err
+		}
+		if ok {
+			claimed = append(claimed, held)
+		}
+	}
+	return claimed, nil
+}
+
+// unclaimHeldExit puts a claimed exit back into the deadline index
+func (r *redisWrapper) unclaimHeldExit(held heldExit, deadline time.Time) error {
+	ctx := context.Background()
+	err := r.client.ZAdd(ctx, heldExitsKey, redis.Z{Score: float64(deadline.Unix()), Member: held.key}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to unclaim held exit: %w", err)
+	}
+	return nil
+}
+
+// migrateHeldExits moves exits held by an older version to their exit id key. Exits used to be
+// parked under held:<plate> with the bare plate in exits:held, and then under <garage>held:<plate>.
+// Replicas migrating at the same time write the same keys.
+func (r *redisWrapper) migrateHeldExits() error {
+	ctx := context.Background()
+	members, err := r.client.ZRangeWithScores(ctx, heldExitsKey, 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list held exits: %w", err)
+	}
+
+	for _, member := range members {
+		old := member.Member.(string)
+		if !strings.Contains(old, "held:") {
+			old = "held:" + old
+		}
+		held, ok, err := r.heldExitAt(old)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// Released while the older version was shutting down
+			if err := r.client.ZRem(ctx, heldExitsKey, member.Member).Err(); err != nil {
+				return fmt.Errorf("failed to remove held exit %s: %w", old, err)
+			}
+			continue
+		}
+		held.Exit.GarageId = garageOrDefault(held.Exit.GarageId)
+		if held.Exit.Id != "" && old == heldExitKey(held.Exit.GarageId, held.Exit.Id) {
+			continue
+		}
+
+		if held.Exit.Id == "" {
+			held.Exit.Id = randomId()
+		}
+		bytes, err := json.Marshal(held)
+		if err != nil {
+			return fmt.Errorf("failed to marshal held exit: %w", err)
+		}
+		key := heldExitKey(held.Exit.GarageId, held.Exit.Id)
+		_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, bytes, 0)
+			pipe.ZAdd(ctx, heldExitsKey, redis.Z{Score: member.Score, Member: key})
+			pipe.ZAdd(ctx, plateHeldExitsKey(held.Exit.GarageId, held.Exit.VehiclePlate), redis.Z{Score: float64(held.HeldAt.Unix()), Member: key})
+			pipe.ZRem(ctx, heldExitsKey, member.Member)
+			pipe.Del(ctx, old)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to migrate held exit %s: %w", old, err)
+		}
+		log.Printf("Migrated held exit %s to %s", old, key)
+	}
+	return nil
+}
+
+// acquireLock takes the named lock for ttl unless another holder has it
+func (r *redisWrapper) acquireLock(name, token string, ttl time.Duration) (bool, error) {
+	ctx := context.Background()
+	ok, err := r.client.SetNX(ctx, "lock:"+name, token, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire lock %s: %w", name, err)
+	}
+	return ok, nil
+}
+
+func (r *redisWrapper) releaseLock(name, token string) error {
+	ctx := context.Background()
+	err := releaseLockScript.Run(ctx, r.client, []string{"lock:" + name}, token).Err()
+	if err != nil {
+		return fmt.Errorf("failed to release lock %s: %w", name, err)
+	}
+	return nil
+}
+
+// currentSession returns the session the plate is currently pointing at in the garage, open or orphaned
+func (r *redisWrapper) currentSession(garage, vehiclePlate string) (session, bool, error) {
+	ctx := context.Background()
+	id, err := r.client.Get(ctx, openSessionKey(garage, vehiclePlate)).Result()
+	if err == redis.Nil {
+		return session{}, false, nil
+	}
+	if err != nil {
+		return session{}, false, fmt.Errorf("failed to get open session: %w", err)
+	}
+	return r.getSession(ctx, id)
+}
+
+// listSessions pages through the garage's open or orphaned sessions in the order they were indexed,
+// starting at since: the entry time for open sessions, the time they were flagged for orphaned ones.
+func (r *redisWrapper) listSessions(garage string, state sessionState, since time.Time, offset, limit int) ([]session, error) {
+	ctx := context.Background()
+	key := openSessionsKey(garage)
+	if state == sessionOrphaned {
+		key = orphanedSessionsKey(garage)
+	}
+	min := "-inf"
+	if !since.IsZero() {
+		min = fmt.Sprint(since.Unix())
+	}
+
+	ids, err := r.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+		Min:    min,
+		Max:    "+inf",
+		Offset: int64(offset),
+		Count:  int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	sessions := []session{}
+	for _, id := range ids {
+		s, ok, err := r.getSession(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+func (r *redisWrapper) openSessionCount(garage string) (int64, error) {
+	ctx := context.Background()
+	count, err := r.client.ZCard(ctx, openSessionsKey(garage)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count open sessions: %w", err)
+	}
+	return count, nil
+}
+
+// sessionHistory returns the plate's sessions in the garage, newest first. Sessions past their
+// retention are skipped.
+func (r *redisWrapper) sessionHistory(garage, vehiclePlate string) ([]session, error) {
+	ctx := context.Background()
+	ids, err := r.client.ZRevRange(ctx, historyKey(garage, vehiclePlate), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session history: %w", err)
+	}
+
+	sessions := []session{}
+	for _, id := range ids {
+		s, ok, err := r.getSession(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+func spoolKey(sink string) string {
+	return "spool:" + sink
+}
+
+func consumerKey(consumer string) string {
+	return "consumer:" + consumer
+}
+
+// spoolSummary adds the summary to the spool of every sink in one transaction, so a failed
+// enqueue spools it nowhere and its retry does not duplicate it in the sinks that got it
+func (r *redisWrapper) spoolSummary(sinks []string, entry spooledSummary) error {
 	ctx := context.Background()
 	bytes, err := json.Marshal(entry)
 	if err != nil {
-		log.Fatalf("Failed to marshal entry event: %s", err)
+		return fmt.Errorf("failed to marshal spooled summary: %w", err)
+	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, sink := range sinks {
+			pipe.XAdd(ctx, &redis.XAddArgs{Stream: spoolKey(sink), Values: []interface{}{"entry", bytes}})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to spool summary: %w", err)
+	}
+	return nil
+}
+
+// heartbeat marks the consumer alive for ttl
+func (r *redisWrapper) heartbeat(consumer string, ttl time.Duration) error {
+	ctx := context.Background()
+	err := r.client.Set(ctx, consumerKey(consumer), time.Now().UTC().Format(time.RFC3339), ttl).Err()
+	if err != nil {
+		return fmt.Errorf("failed to refresh heartbeat of %s: %w", consumer, err)
+	}
+	return nil
+}
+
+// readSpool hands the consumer up to count summaries no other consumer has read, waiting up to
+// block for new ones
+func (r *redisWrapper) readSpool(sink, consumer string, count int, block time.Duration) ([]spooledSummary, error) {
+	ctx := context.Background()
+	err := r.client.XGroupCreateMkStream(ctx, spoolKey(sink), spoolGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, fmt.Errorf("failed to create spool group for %s: %w", sink, err)
+	}
+
+	streams, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    spoolGroup,
+		Consumer: consumer,
+		Streams:  []string{spoolKey(sink), ">"},
+		Count:    int64(count),
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool of %s: %w", sink, err)
+	}
+	entries := []spooledSummary{}
+	for _, stream := range streams {
+		entries = append(entries, spooledSummaries(stream.Messages)...)
+	}
+	return entries, nil
+}
+
+// claimStaleSpool takes over summaries that a consumer without a heartbeat, a replica that
+// stopped, has not acknowledged for minIdle. Summaries of live consumers are left alone, they can
+// be waiting for a sink's circuit breaker.
+func (r *redisWrapper) claimStaleSpool(sink, consumer string, minIdle time.Duration, count int) ([]spooledSummary, error) {
+	ctx := context.Background()
+	pending, err := r.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: spoolKey(sink),
+		Group:  spoolGroup,
+		Idle:   minIdle,
+		Start:  "-",
+		End:    "+",
+		Count:  int64(count),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pending spool of %s: %w", sink, err)
+	}
+
+	alive := map[string]bool{consumer: true}
+	ids := []string{}
+	for _, entry := range pending {
+		live, ok := alive[entry.Consumer]
+		if !ok {
+			count, err := r.client.Exists(ctx, consumerKey(entry.Consumer)).Result()
+			if err != nil {
+				return nil, fmt.Errorf("failed to check heartbeat of %s: %w", entry.Consumer, err)
+			}
+			live = count > 0
+			alive[entry.Consumer] = live
+		}
+		if !live {
+			ids = append(ids, entry.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	// MinIdle again, so of two replicas claiming at once only one gets each summary
+	messages, err := r.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   spoolKey(sink),
+		Group:    spoolGroup,
+		Consumer: consumer,
+		MinIdle:  minIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim stale spool of %s: %w", sink, err)
 	}
+	return spooledSummaries(messages), nil
+}
+
+func spooledSummaries(messages []redis.XMessage) []spooledSummary {
+	entries := []spooledSummary{}
+	for _, message := range messages {
+		entry := spooledSummary{}
+		value, _ := message.Values["entry"].(string)
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			log.Printf("Skipping malformed spool entry %s: %s", message.ID, err)
+			continue
+		}
+		entry.StreamId = message.ID
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// ackSpool removes a delivered summary from the spool
+func (r *redisWrapper) ackSpool(sink string, entry spooledSummary) error {
+	ctx := context.Background()
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, spoolKey(sink), spoolGroup, entry.StreamId)
+		pipe.XDel(ctx, spoolKey(sink), entry.StreamId)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to acknowledge spooled summary for %s: %w", sink, err)
+	}
+	return nil
+}
 
-	err = r.client.Set(ctx, entry.VehiclePlate, bytes, 0).Err()
+// deadLetterSpool moves a summary the sink gave up on to spool:<sink>:dead
+func (r *redisWrapper) deadLetterSpool(sink string, entry spooledSummary, reason string) error {
+	ctx := context.Background()
+	bytes, err := json.Marshal(entry)
 	if err != nil {
-		log.Fatalf("Failed to store entry event: %s", err)
+		return fmt.Errorf("failed to marshal spooled summary: %w", err)
 	}
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: spoolKey(sink) + ":dead", Values: []interface{}{"entry", bytes, "reason", reason}})
+		pipe.XAck(ctx, spoolKey(sink), spoolGroup, entry.StreamId)
+		pipe.XDel(ctx, spoolKey(sink), entry.StreamId)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter spooled summary for %s: %w", sink, err)
+	}
+	return nil
 }
 
-func (r *redisWrapper) get(vehiclePlate string) (entryEvent, bool) {
+// spoolDepth counts the summaries still waiting for delivery, including those being delivered
+func (r *redisWrapper) spoolDepth(sink string) (int64, error) {
 	ctx := context.Background()
-	entryEvent := entryEvent{}
-	val, err := r.client.Get(ctx, vehiclePlate).Result()
+	depth, err := r.client.XLen(ctx, spoolKey(sink)).Result()
 	if err != nil {
-		log.Println("Failed to get entry event: ", err)
-		return entryEvent, false
+		return 0, fmt.Errorf("failed to get spool depth of %s: %w", sink, err)
 	}
-	json.Unmarshal([]byte(val), &entryEvent)
-	return entryEvent, true
+	return depth, nil
+}
+
+func randomId() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
 }
 
 func createRedisClient(redisURL string) (*redis.Client, error) {
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"backend/billing"
+	"health"
+)
+
+var (
+	sinkDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "summary_sink_deliveries_total",
+		Help: "Summary delivery attempts per sink by outcome: success, retry or dead",
+	}, []string{"sink", "outcome"})
+	sinkLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "summary_sink_latency_seconds",
+		Help:    "Latency of single summary delivery attempts per sink in seconds",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"sink"})
+)
+
+func init() {
+	prometheus.MustRegister(sinkDeliveries)
+	prometheus.MustRegister(sinkLatency)
+}
+
+// Destination for exit summaries. The idempotency key is the same for every delivery of one
+// summary, sinks that can should use it to drop duplicates.
+type summarySink interface {
+	deliver(ctx context.Context, summary billing.Summary, idempotencyKey string) error
+}
+
+// Zero maxAttempts retries until the sink takes the summary
+type retryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+}
+
+// Spools every summary once per sink. The sink workers deliver the spools in the background, so
+// the exit consumer keeps going while a sink is slow or down.
+type summaryFanout struct {
+	store   spoolStore
+	workers []*sinkWorker
+	// Identifies this replica in the spools' consumer group
+	consumer string
+}
+
+// How often a replica refreshes its heartbeat, it counts as stopped after three missed ones
+const heartbeatInterval = 10 * time.Second
+
+func (f *summaryFanout) enqueue(ctx context.Context, summary billing.Summary, idempotencyKey string) error {
+	// The workers continue the exit's trace when they deliver
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+
+	sinks := []string{}
+	for _, worker := range f.workers {
+		sinks = append(sinks, worker.name)
+	}
+	entry := spooledSummary{Summary: summary, IdempotencyKey: idempotencyKey, TraceParent: carrier.Get("traceparent"), SpooledAt: time.Now().UTC()}
+	return f.store.spoolSummary(sinks, entry)
+}
+
+// healthChecks reports every sink whose circuit breaker is open. Summaries keep being spooled
+// meanwhile, so the sinks are optional dependencies.
+func (f *summaryFanout) healthChecks() []health.Check {
+	checks := []health.Check{}
+	for _, worker := range f.workers {
+		checks = append(checks, health.Check{
+			Name:     "sink:" + worker.name,
+			Optional: true,
+			Check: func(ctx context.Context) error {
+				if worker.breaker.isOpen() {
+					return errors.New("circuit breaker open")
+				}
+				return nil
+			},
+		})
+	}
+	return checks
+}
+
+func (f *summaryFanout) run() {
+	// Alive before reading, another replica could claim the summaries otherwise
+	if err := f.store.heartbeat(f.consumer, 3*heartbeatInterval); err != nil {
+		log.Println(err)
+	}
+	go f.heartbeat()
+	for _, worker := range f.workers {
+		go worker.run()
+	}
+}
+
+func (f *summaryFanout) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := f.store.heartbeat(f.consumer, 3*heartbeatInterval); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Posts summaries as JSON. Used for the writer service and for generic webhooks.
+type httpSink struct {
+	client  httpClienter
+	url     string
+	headers map[string]string
+	// Observe request latency in post_request_latency_seconds, kept for the writer
+	observeLatency bool
+}
+
+func (s *httpSink) deliver(ctx context.Context, summary billing.Summary, idempotencyKey string) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to marshal summary: %w", err)
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		httpRequest.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	for k, v := range s.headers {
+		httpRequest.Header.Set(k, v)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(httpRequest.Header))
+
+	start := time.Now()
+	httpResponse, err := s.client.Do(httpRequest)
+	if s.observeLatency {
+		postRequestLatency.Observe(time.Since(start).Seconds())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	httpResponse.Body.Close()
+	status := httpResponse.StatusCode
+	if status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+		return permanentError{fmt.Errorf("%s rejected the summary with status %d", s.url, status)}
+	}
+	if status < 200 || status > 299 {
+		return fmt.Errorf("%s responded with status %d", s.url, status)
+	}
+	return nil
+}
+
+// Writes summaries as NDJSON to out, for instance stdout
+type writerSink struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func (s *writerSink) deliver(ctx context.Context, summary billing.Summary, idempotencyKey string) error {
+	line, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to marshal summary: %w", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.out.Write(append(line, '\n'))
+	return err
+}
+
+// Appends summaries as NDJSON to a local file. Once the file would exceed maxBytes it is rotated
+// to path.1, path.1 to path.2 and so on, keeping at most maxFiles old files.
+type fileSink struct {
+	mutex    sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func (s *fileSink) deliver(ctx context.Context, summary billing.Summary, idempotencyKey string) error {
+	line, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to marshal summary: %w", err)
+	}
+	line = append(line, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file != nil && s.maxBytes > 0 && s.size+int64(len(line)) > s.maxBytes {
+		err = s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		err = s.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.path, err)
+	}
+	return nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", s.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat %s: %w", s.path, err)
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *fileSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close %s: %w", s.path, err)
+	}
+
+	for i := s.maxFiles - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", s.path, i)
+		to := fmt.Sprintf("%s.%d", s.path, i+1)
+		if err := os.Rename(from, to); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate %s: %w", from, err)
+		}
+	}
+	if s.maxFiles > 0 {
+		err = os.Rename(s.path, s.path+".1")
+	} else {
+		err = os.Remove(s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to rotate %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// Adds summaries to a Redis stream, capped at roughly maxLen entries
+type redisStreamSink struct {
+	client *redis.Client
+	stream string
+	maxLen int64
+}
+
+func (s *redisStreamSink) deliver(ctx context.Context, summary billing.Summary, idempotencyKey string) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to marshal summary: %w", err)
+	}
+	err = s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.stream,
+		MaxLen: s.maxLen,
+		Approx: true,
+		Values: map[string]interface{}{"summary": body, "idempotency_key": idempotencyKey},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to add summary to stream %s: %w", s.stream, err)
+	}
+	return nil
+}
+
+// newSummaryFanout builds the sinks listed in SUMMARY_SINKS, a comma separated list of writer,
+// file, redis-stream, webhook and stdout. Each sink reads its own SINK_<NAME>_* settings.
+func newSummaryFanout(httpClient httpClienter, database *redisWrapper, consumer string) (*summaryFanout, error) {
+	names := os.Getenv("SUMMARY_SINKS")
+	if names == "" {
+		names = "writer"
+	}
+
+	fanout := &summaryFanout{store: database, consumer: consumer}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		var sink summarySink
+
+		switch name {
+		case "writer":
+			writerHost := os.Getenv("WRITER_HOST")
+			writerPort := os.Getenv("WRITER_PORT")
+			if writerHost == "" || writerPort == "" {
+				return nil, fmt.Errorf("WRITER_HOST and WRITER_PORT must be set")
+			}
+			writerURL := fmt.Sprintf("http://%s:%s/log", writerHost, writerPort)
+			sink = &httpSink{client: httpClient, url: writerURL, observeLatency: true}
+		case "file":
+			path := os.Getenv("SINK_FILE_PATH")
+			if path == "" {
+				return nil, fmt.Errorf("SINK_FILE_PATH must be set")
+			}
+			sink = &fileSink{
+				path:     path,
+				maxBytes: int64(getEnvInt("SINK_FILE_MAX_BYTES", 100<<20)),
+				maxFiles: getEnvInt("SINK_FILE_MAX_FILES", 5),
+			}
+		case "redis-stream":
+			stream := os.Getenv("SINK_REDIS_STREAM_NAME")
+			if stream == "" {
+				stream = "summaries"
+			}
+			sink = &redisStreamSink{client: database.client, stream: stream, maxLen: int64(getEnvInt("SINK_REDIS_STREAM_MAX_LEN", 100000))}
+		case "webhook":
+			url := os.Getenv("SINK_WEBHOOK_URL")
+			if url == "" {
+				return nil, fmt.Errorf("SINK_WEBHOOK_URL must be set")
+			}
+			sink = &httpSink{client: httpClient, url: url, headers: parseHeaders(os.Getenv("SINK_WEBHOOK_HEADERS"))}
+		case "stdout":
+			sink = &writerSink{out: os.Stdout}
+		default:
+			return nil, fmt.Errorf("unknown summary sink %q", name)
+		}
+
+		prefix := "SINK_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		fanout.workers = append(fanout.workers, &sinkWorker{
+			name: name,
+			sink: sink,
+			retry: retryPolicy{
+				maxAttempts: getEnvInt(prefix+"MAX_ATTEMPTS", 0),
+				backoff:     time.Duration(getEnvInt(prefix+"BACKOFF_MS", 1000)) * time.Millisecond,
+				maxBackoff:  time.Duration(getEnvInt(prefix+"MAX_BACKOFF_MS", 60000)) * time.Millisecond,
+			},
+			breaker: &circuitBreaker{
+				sink:      name,
+				threshold: getEnvInt(prefix+"BREAKER_FAILURES", 5),
+				cooldown:  time.Duration(getEnvInt(prefix+"BREAKER_COOLDOWN_MS", 30000)) * time.Millisecond,
+			},
+			store:      database,
+			consumer:   consumer,
+			bufferSize: max(getEnvInt("SPOOL_BUFFER_SIZE", 100), 1),
+			claimIdle:  time.Duration(getEnvInt("SPOOL_CLAIM_IDLE_SECONDS", 300)) * time.Second,
+			sleep:      time.Sleep,
+		})
+	}
+	return fanout, nil
+}
+
+// parseHeaders reads "Name: value" pairs separated by semicolons
+func parseHeaders(value string) map[string]string {
+	headers := map[string]string{}
+	for _, header := range strings.Split(value, ";") {
+		name, v, ok := strings.Cut(header, ":")
+		if ok {
+			headers[strings.TrimSpace(name)] = strings.TrimSpace(v)
+		}
+	}
+	return headers
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	orphanedQueueName = "orphaned-session"
+	sweeperLockName   = "orphan-sweeper"
+)
+
+var orphanedSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "orphaned_sessions",
+	Help: "Sessions flagged as orphaned because the vehicle stayed longer than the maximum stay",
+}, []string{"garage"})
+
+func init() {
+	prometheus.MustRegister(orphanedSessions)
+}
+
+type orphanStore interface {
+	garages() ([]string, error)
+	orphanSessions(time.Time) ([]session, error)
+	orphanedSessionCount(garage string) (int64, error)
+	acquireLock(name, token string, ttl time.Duration) (bool, error)
+	releaseLock(name, token string) error
+}
+
+// Periodically flags open sessions older than maxStay as orphaned, the exit camera most likely
+// missed the vehicle. Replicas take turns through a Redis lock, so each sweep runs once.
+type orphanSweeper struct {
+	database  orphanStore
+	publisher amqpPublisher
+	maxStay   time.Duration
+	interval  time.Duration
+	// Identifies this replica as the lock holder
+	token string
+}
+
+func (s *orphanSweeper) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := s.sweep(time.Now()); err != nil {
+			log.Println("Orphan sweep failed: ", err)
+		}
+	}
+}
+
+// sweep flags and announces stale sessions, it returns how many were flagged by this replica
+func (s *orphanSweeper) sweep(now time.Time) (int, error) {
+	locked, err := s.database.acquireLock(sweeperLockName, s.token, s.interval)
+	if err != nil {
+		return 0, err
+	}
+	if !locked {
+		// Another replica is sweeping, only refresh the gauge
+		return 0, s.updateGauge()
+	}
+	defer func() {
+		if err := s.database.releaseLock(sweeperLockName, s.token); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	orphaned, err := s.database.orphanSessions(now.Add(-s.maxStay))
+	for _, session := range orphaned {
+		log.Printf("Session %s of %s in garage %s orphaned, entered at %s", session.Id, session.VehiclePlate, session.GarageId, session.EntryDateTime)
+		if err := s.publish(session); err != nil {
+			log.Println(err)
+		}
+	}
+	if err != nil {
+		return len(orphaned), err
+	}
+	return len(orphaned), s.updateGauge()
+}
+
+func (s *orphanSweeper) publish(session session) error {
+	body, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal orphaned session: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = s.publisher.PublishWithContext(ctx,
+		"",                // exchange
+		orphanedQueueName, // routing key
+		false,             // mandatory
+		false,             // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		})
+	if err != nil {
+		return fmt.Errorf("failed to publish orphaned session %s: %w", session.Id, err)
+	}
+	return nil
+}
+
+func (s *orphanSweeper) updateGauge() error {
+	garages, err := s.database.garages()
+	if err != nil {
+		return err
+	}
+	for _, garage := range garages {
+		count, err := s.database.orphanedSessionCount(garage)
+		if err != nil {
+			return err
+		}
+		orphanedSessions.WithLabelValues(garage).Set(float64(count))
+	}
+	return nil
+}
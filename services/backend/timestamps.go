@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Wire format of event timestamps, shared with the simulator
+const eventTimeLayout = time.RFC3339Nano
+
+// Layout of time.Time.String(), which the simulator used to send. The string may also carry a
+// monotonic clock reading such as " m=+12.3", which is dropped before parsing.
+const legacyEventTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// Whether legacy timestamps are still accepted, switched off once all simulators are migrated
+var acceptLegacyTimestamps = true
+
+var (
+	legacyTimestamps = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "legacy_timestamps_total",
+		Help: "Event timestamps received in the legacy time.Time.String() format",
+	})
+	timestampAnomalies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "timestamp_anomalies_total",
+		Help: "Exit events rejected because they are earlier than their entry",
+	}, []string{"garage", "gate"})
+)
+
+func init() {
+	prometheus.MustRegister(legacyTimestamps)
+	prometheus.MustRegister(timestampAnomalies)
+}
+
+// parseEventTime parses an event timestamp in the canonical format, falling back to the legacy one
+// while it is accepted. The result is in UTC.
+func parseEventTime(value string) (time.Time, error) {
+	parsed, err := time.Parse(eventTimeLayout, value)
+	if err == nil {
+		return parsed.UTC(), nil
+	}
+	if !acceptLegacyTimestamps {
+		return time.Time{}, fmt.Errorf("timestamp %q is not RFC 3339", value)
+	}
+
+	legacy := value
+	if i := strings.Index(legacy, " m="); i >= 0 {
+		legacy = legacy[:i]
+	}
+	parsed, legacyErr := time.Parse(legacyEventTimeLayout, legacy)
+	if legacyErr != nil {
+		return time.Time{}, fmt.Errorf("timestamp %q is neither RFC 3339 nor the legacy format", value)
+	}
+	legacyTimestamps.Inc()
+	return parsed.UTC(), nil
+}
+
+func formatEventTime(t time.Time) string {
+	return t.UTC().Format(eventTimeLayout)
+}
@@ -0,0 +1,3 @@
+module groundtruth
+
+go 1.23.0
@@ -0,0 +1,18 @@
+// Package groundtruth describes the simulator's ground-truth log, which the backend's scorer
+// compares the summaries with.
+package groundtruth
+
+// One event as it really happened and as the camera reported it. A dropped event was never
+// published and has no published plate or time.
+type Record struct {
+	Event          string   `json:"event"`
+	EventId        string   `json:"event_id"`
+	Plate          string   `json:"plate"`
+	Time           string   `json:"time"`
+	PublishedPlate string   `json:"published_plate,omitempty"`
+	PublishedTime  string   `json:"published_time,omitempty"`
+	Faults         []string `json:"faults,omitempty"`
+	GarageId       string   `json:"garage_id,omitempty"`
+	GateId         string   `json:"gate_id,omitempty"`
+	LaneId         string   `json:"lane_id,omitempty"`
+}
@@ -0,0 +1,108 @@
+// Package health serves the /healthz and /readyz endpoints of the backend and the simulator, and
+// runs the healthcheck subcommand their Compose healthchecks use.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Dependency reported by /readyz
+type Check struct {
+	Name string
+	// A failing optional dependency degrades the service without making it unready
+	Optional bool
+	Check    func(ctx context.Context) error
+}
+
+type DependencyStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Response struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies,omitempty"`
+}
+
+// Serves /healthz, whether the process can still do its work or needs a restart, and /readyz,
+// whether its dependencies are up
+type Handler struct {
+	Live   func() error
+	Checks []Check
+}
+
+func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", h.healthz)
+	mux.HandleFunc("GET /readyz", h.readyz)
+}
+
+func (h *Handler) healthz(w http.ResponseWriter, r *http.Request) {
+	if err := h.Live(); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, Response{Status: "down", Dependencies: map[string]DependencyStatus{
+			"process": {Status: "down", Error: err.Error()},
+		}})
+		return
+	}
+	writeJSON(w, http.StatusOK, Response{Status: "ok"})
+}
+
+func (h *Handler) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	response := Response{Status: "ok", Dependencies: map[string]DependencyStatus{}}
+	status := http.StatusOK
+	for _, check := range h.Checks {
+		err := check.Check(ctx)
+		switch {
+		case err == nil:
+			response.Dependencies[check.Name] = DependencyStatus{Status: "ok"}
+		case check.Optional:
+			response.Dependencies[check.Name] = DependencyStatus{Status: "degraded", Error: err.Error()}
+			if response.Status == "ok" {
+				response.Status = "degraded"
+			}
+		default:
+			response.Dependencies[check.Name] = DependencyStatus{Status: "down", Error: err.Error()}
+			response.Status = "down"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, response)
+}
+
+// RunHealthcheck requests url and reports success as exit code 0, failures are written to stderr.
+// The images have no shell or curl, so Compose healthchecks run the binary itself:
+// <program> healthcheck <url>.
+func RunHealthcheck(program string, args []string, stderr io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintf(stderr, "usage: %s healthcheck <url>\n", program)
+		return 2
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Get(args[0])
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		fmt.Fprintln(stderr, args[0], "responded with status", response.StatusCode)
+		return 1
+	}
+	return 0
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Println("Failed to write response: ", err)
+	}
+}
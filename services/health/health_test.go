@@ -0,0 +1,55 @@
+package health
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	handler := &Handler{
+		Live: func() error { return nil },
+		Checks: []Check{
+			{Name: "amqp", Check: func(ctx context.Context) error { return errors.New("channel closed") }},
+		},
+	}
+	mux := http.NewServeMux()
+	handler.Register(mux)
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), "channel closed") {
+		t.Errorf("Expected not ready with the AMQP error, got %d %s", recorder.Code, recorder.Body)
+	}
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected live, got %d", recorder.Code)
+	}
+}
+
+func TestRunHealthcheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/readyz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	stderr := &bytes.Buffer{}
+	if code := RunHealthcheck("backend", []string{server.URL + "/readyz"}, stderr); code != 0 || stderr.Len() != 0 {
+		t.Errorf("Expected exit code 0 and no output, got %d %q", code, stderr)
+	}
+	if code := RunHealthcheck("backend", []string{server.URL + "/healthz"}, stderr); code != 1 || !strings.Contains(stderr.String(), "503") {
+		t.Errorf("Expected exit code 1 with the status on stderr, got %d %q", code, stderr)
+	}
+	stderr.Reset()
+	if code := RunHealthcheck("backend", nil, stderr); code != 2 || !strings.HasPrefix(stderr.String(), "usage: backend healthcheck") {
+		t.Errorf("Expected the usage on stderr, got %d %q", code, stderr)
+	}
+}
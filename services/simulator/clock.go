@@ -0,0 +1,159 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Time as seen by the simulated garage, used for both waiting and event timestamps
+type clocker interface {
+	now() time.Time
+	sleep(time.Duration)
+}
+
+// Settings of the simulated time
+type CLOCK struct {
+	// How many times faster than real time the simulation runs
+	SPEED float64 `json:"SPEED"`
+	// RFC 3339 time the simulation starts at, now when empty
+	START_TIME string `json:"START_TIME"`
+}
+
+// Simulated time starting at start and running speed times faster than real time
+type virtualClock struct {
+	start     time.Time
+	realStart time.Time
+	speed     float64
+}
+
+func newVirtualClock(config CLOCK) (*virtualClock, error) {
+	clock := &virtualClock{realStart: time.Now(), speed: config.SPEED}
+	if clock.speed == 0 {
+		clock.speed = 1
+	}
+	if clock.speed < 0 {
+		return nil, fmt.Errorf("clock speed must be positive, got %g", config.SPEED)
+	}
+	clock.start = clock.realStart
+	if config.START_TIME != "" {
+		start, err := time.Parse(time.RFC3339, config.START_TIME)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clock start time: %w", err)
+		}
+		clock.start = start
+	}
+	return clock, nil
+}
+
+func (c *virtualClock) now() time.Time {
+	elapsed := time.Duration(float64(time.Since(c.realStart)) * c.speed)
+	return c.start.Add(elapsed)
+}
+
+func (c *virtualClock) sleep(d time.Duration) {
+	time.Sleep(time.Duration(float64(d) / c.speed))
+}
+
+// Clock stopped at one instant
+type instant time.Time
+
+func (i instant) now() time.Time {
+	return time.Time(i)
+}
+
+func (i instant) sleep(time.Duration) {}
+
+// Clock the simulation loop runs on. Steps run one at a time in the order of their simulated
+// time, and while one runs now is the instant it was scheduled for rather than whenever the sleep
+// ended, so that a seeded run publishes the same events at the same times. Actions scheduled with
+// after, such as delayed events, run between the steps at their own instant.
+type stepClock struct {
+	clocker
+
+	mutex sync.Mutex
+	// Instant of the running step, zero between steps
+	current time.Time
+	timers  timerQueue
+	// Keeps timers due at the same instant in the order they were scheduled
+	scheduled int
+}
+
+// Action due at a simulated time
+type timer struct {
+	at     time.Time
+	order  int
+	action func()
+}
+
+// Timers ordered by time, a container/heap
+type timerQueue []timer
+
+func (q timerQueue) Len() int { return len(q) }
+func (q timerQueue) Less(i, j int) bool {
+	return q[i].at.Before(q[j].at) || q[i].at.Equal(q[j].at) && q[i].order < q[j].order
+}
+func (q timerQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *timerQueue) Push(x any)   { *q = append(*q, x.(timer)) }
+func (q *timerQueue) Pop() any {
+	old := *q
+	last := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return last
+}
+
+func (c *stepClock) now() time.Time {
+	c.mutex.Lock()
+	current := c.current
+	c.mutex.Unlock()
+	if !current.IsZero() {
+		return current
+	}
+	return c.clocker.now()
+}
+
+// after schedules action d after now
+func (c *stepClock) after(d time.Duration, action func()) {
+	at := c.now().Add(d)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.scheduled++
+	heap.Push(&c.timers, timer{at: at, order: c.scheduled, action: action})
+}
+
+// step runs the timers due until at, then waits until at and runs step there
+func (c *stepClock) step(at time.Time, step func()) {
+	c.runTimers(at)
+	c.run(at, step)
+}
+
+// runTimers runs the timers due until at, or all of them for a zero at
+func (c *stepClock) runTimers(at time.Time) {
+	for {
+		c.mutex.Lock()
+		if len(c.timers) == 0 || !at.IsZero() && c.timers[0].at.After(at) {
+			c.mutex.Unlock()
+			return
+		}
+		due := heap.Pop(&c.timers).(timer)
+		c.mutex.Unlock()
+		c.run(due.at, due.action)
+	}
+}
+
+// run waits until at and runs action with the clock stopped there
+func (c *stepClock) run(at time.Time, action func()) {
+	if wait := at.Sub(c.clocker.now()); wait > 0 {
+		c.clocker.sleep(wait)
+	}
+	c.mutex.Lock()
+	c.current = at
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		c.current = time.Time{}
+		c.mutex.Unlock()
+	}()
+	action()
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Controls the running simulation over HTTP. Settings use the keys of config.json, and every
+// change is made under the mutex of the garage or cameras it touches, so the tolls never see
+// half of one. Every request needs the token as a bearer token.
+type controlAPI struct {
+	garages []*garage
+	cameras *cameraNoise
+	clock   clocker
+	token   string
+}
+
+// Runtime settings of a garage that PATCH changes
+type garageChanges struct {
+	CAPACITY          int     `json:"CAPACITY"`
+	ARRIVALS_PER_HOUR float64 `json:"ARRIVALS_PER_HOUR"`
+	MAX_ENTRY_WAIT    int     `json:"MAX_ENTRY_WAIT"`
+	MAX_EXIT_WAIT     int     `json:"MAX_EXIT_WAIT"`
+	ENTRY_PAUSED      bool    `json:"ENTRY_PAUSED"`
+	EXIT_PAUSED       bool    `json:"EXIT_PAUSED"`
+}
+
+// Runtime settings of a garage, with its read-only ID and OCCUPIED
+type garageSettings struct {
+	ID string `json:"ID"`
+	garageChanges
+	OCCUPIED int `json:"OCCUPIED"`
+}
+
+type controlState struct {
+	NOISE   NOISE            `json:"NOISE"`
+	GARAGES []garageSettings `json:"GARAGES"`
+}
+
+type parkingLotResponse struct {
+	ID   string   `json:"ID"`
+	CARS []string `json:"CARS"`
+}
+
+// One-off car driven through a toll
+type scriptedCar struct {
+	VEHICLE_PLATE string `json:"VEHICLE_PLATE"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (a *controlAPI) register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /control", a.authorized(a.getState))
+	mux.HandleFunc("PATCH /control/noise", a.authorized(a.patchNoise))
+	mux.HandleFunc("PATCH /control/garages/{garage}", a.authorized(a.patchGarage))
+	mux.HandleFunc("GET /control/garages/{garage}/cars", a.authorized(a.getCars))
+	mux.HandleFunc("POST /control/garages/{garage}/entries", a.authorized(a.postEntry))
+	mux.HandleFunc("POST /control/garages/{garage}/exits", a.authorized(a.postExit))
+}
+
+// authorized answers 401 unless the request carries the token, without a token nothing passes
+func (a *controlAPI) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "a valid bearer token is required")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (a *controlAPI) getState(w http.ResponseWriter, r *http.Request) {
+	state := controlState{NOISE: a.cameras.settings(), GARAGES: []garageSettings{}}
+	for _, garage := range a.garages {
+		garage.mutex.Lock()
+		state.GARAGES = append(state.GARAGES, garage.settings())
+		garage.mutex.Unlock()
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// patchNoise changes the NOISE keys in the body and leaves the others as they are
+func (a *controlAPI) patchNoise(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	// Taken before the cameras' mutex, the tolls lock a garage before they reach the cameras
+	garages := []GARAGE{}
+	for _, garage := range a.garages {
+		garage.mutex.Lock()
+		garages = append(garages, garage.config)
+		garage.mutex.Unlock()
+	}
+	a.cameras.mutex.Lock()
+	defer a.cameras.mutex.Unlock()
+	noise := a.cameras.config
+	// A map in the body replaces the current one instead of being merged into it
+	noise.GATE_DROP_RATES, noise.CAMERA_CLOCK_SKEW_SECONDS = nil, nil
+	if err := decodeStrict(body, &noise); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if noise.GATE_DROP_RATES == nil {
+		noise.GATE_DROP_RATES = a.cameras.config.GATE_DROP_RATES
+	}
+	if noise.CAMERA_CLOCK_SKEW_SECONDS == nil {
+		noise.CAMERA_CLOCK_SKEW_SECONDS = a.cameras.config.CAMERA_CLOCK_SKEW_SECONDS
+	}
+	if err := noise.validate(gateLanes(garages)); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	a.cameras.config = noise
+	writeJSON(w, http.StatusOK, noise)
+}
+
+// patchGarage changes the settings in the body and leaves the others as they are. The read-only
+// ID and OCCUPIED are rejected like unknown keys.
+func (a *controlAPI) patchGarage(w http.ResponseWriter, r *http.Request) {
+	garage, ok := a.garage(w, r)
+	if !ok {
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	garage.mutex.Lock()
+	defer garage.mutex.Unlock()
+	changes := garage.settings().garageChanges
+	if err := decodeStrict(body, &changes); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := changes.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	garage.apply(changes)
+	writeJSON(w, http.StatusOK, garage.settings())
+}
+
+func (a *controlAPI) getCars(w http.ResponseWriter, r *http.Request) {
+	garage, ok := a.garage(w, r)
+	if !ok {
+		return
+	}
+	garage.mutex.Lock()
+	defer garage.mutex.Unlock()
+	writeJSON(w, http.StatusOK, parkingLotResponse{ID: garage.config.ID, CARS: slices.Clone(garage.parkingLot)})
+}
+
+// postEntry lets a given car in, whether or not the entry toll is paused. The camera may still
+// miss or misread it, set the noise to zero for an exact event.
+func (a *controlAPI) postEntry(w http.ResponseWriter, r *http.Request) {
+	garage, car, ok := a.scriptedCar(w, r)
+	if !ok {
+		return
+	}
+	garage.mutex.Lock()
+	defer garage.mutex.Unlock()
+	if slices.Contains(garage.parkingLot, car.VEHICLE_PLATE) {
+		writeError(w, http.StatusConflict, car.VEHICLE_PLATE+" is already inside "+garage.config.ID)
+		return
+	}
+	if garage.full() {
+		writeError(w, http.StatusConflict, garage.config.ID+" is full")
+		return
+	}
+	enterCar(a.cameras, garage, car.VEHICLE_PLATE, a.cameras, a.clock)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postExit lets a given car out, whether or not the exit toll is paused
+func (a *controlAPI) postExit(w http.ResponseWriter, r *http.Request) {
+	garage, car, ok := a.scriptedCar(w, r)
+	if !ok {
+		return
+	}
+	garage.mutex.Lock()
+	defer garage.mutex.Unlock()
+	carIndex := slices.Index(garage.parkingLot, car.VEHICLE_PLATE)
+	if carIndex < 0 {
+		writeError(w, http.StatusNotFound, car.VEHICLE_PLATE+" is not inside "+garage.config.ID)
+		return
+	}
+	exitCar(garage, carIndex, a.cameras, a.clock)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// garage finds the garage in the path, answering 404 for an unknown one
+func (a *controlAPI) garage(w http.ResponseWriter, r *http.Request) (*garage, bool) {
+	id := r.PathValue("garage")
+	for _, garage := range a.garages {
+		if garage.config.ID == id {
+			return garage, true
+		}
+	}
+	writeError(w, http.StatusNotFound, "unknown garage "+id)
+	return nil, false
+}
+
+func (a *controlAPI) scriptedCar(w http.ResponseWriter, r *http.Request) (*garage, scriptedCar, bool) {
+	car := scriptedCar{}
+	garage, ok := a.garage(w, r)
+	if !ok {
+		return nil, car, false
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return nil, car, false
+	}
+	if err := decodeStrict(body, &car); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil, car, false
+	}
+	if car.VEHICLE_PLATE == "" {
+		writeError(w, http.StatusBadRequest, "VEHICLE_PLATE must be set")
+		return nil, car, false
+	}
+	return garage, car, true
+}
+
+// settings returns the garage's runtime settings, the caller holds the mutex
+func (g *garage) settings() garageSettings {
+	return garageSettings{
+		ID: g.config.ID,
+		garageChanges: garageChanges{
+			CAPACITY:          g.config.CAPACITY,
+			ARRIVALS_PER_HOUR: g.config.ARRIVALS_PER_HOUR,
+			MAX_ENTRY_WAIT:    g.maxEntryWait,
+			MAX_EXIT_WAIT:     g.maxExitWait,
+			ENTRY_PAUSED:      g.entryPaused,
+			EXIT_PAUSED:       g.exitPaused,
+		},
+		OCCUPIED: len(g.parkingLot),
+	}
+}
+
+// apply changes the garage's runtime settings, the caller holds the mutex
+func (g *garage) apply(settings garageChanges) {
+	g.config.CAPACITY = settings.CAPACITY
+	g.config.ARRIVALS_PER_HOUR = settings.ARRIVALS_PER_HOUR
+	g.maxEntryWait = settings.MAX_ENTRY_WAIT
+	g.maxExitWait = settings.MAX_EXIT_WAIT
+	g.entryPaused = settings.ENTRY_PAUSED
+	g.exitPaused = settings.EXIT_PAUSED
+}
+
+func (s garageChanges) validate() error {
+	if s.CAPACITY <= 0 {
+		return errors.New("CAPACITY must be positive")
+	}
+	if s.MAX_ENTRY_WAIT <= 0 || s.MAX_EXIT_WAIT <= 0 {
+		return errors.New("MAX_ENTRY_WAIT and MAX_EXIT_WAIT must be positive")
+	}
+	if s.ARRIVALS_PER_HOUR < 0 {
+		return errors.New("ARRIVALS_PER_HOUR must not be negative")
+	}
+	return nil
+}
+
+// validate checks the rates and that the gate and camera keys name lanes of gates, which maps
+// gate keys to their number of lanes
+func (n NOISE) validate(gates map[string]int) error {
+	rates := map[string]float64{
+		"ENTRY_DROP_RATE":   n.ENTRY_DROP_RATE,
+		"EXIT_DROP_RATE":    n.EXIT_DROP_RATE,
+		"MISREAD_RATE":      n.MISREAD_RATE,
+		"DUPLICATE_RATE":    n.DUPLICATE_RATE,
+		"DELAY_RATE":        n.DELAY_RATE,
+		"OUT_OF_ORDER_RATE": n.OUT_OF_ORDER_RATE,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("%s must be between 0 and 1", name)
+		}
+	}
+	if n.MAX_DELAY_SECONDS < 0 {
+		return errors.New("MAX_DELAY_SECONDS must not be negative")
+	}
+	for key, rate := range n.GATE_DROP_RATES {
+		if _, ok := gates[key]; !ok {
+			return fmt.Errorf("GATE_DROP_RATES has no gate %s, keys are <garage>/<gate>", key)
+		}
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("GATE_DROP_RATES of %s must be between 0 and 1", key)
+		}
+	}
+	for key := range n.CAMERA_CLOCK_SKEW_SECONDS {
+		gate, lane, _ := cutLast(key, "/")
+		number, err := strconv.Atoi(lane)
+		if lanes, ok := gates[gate]; !ok || err != nil || number < 1 || number > lanes {
+			return fmt.Errorf("CAMERA_CLOCK_SKEW_SECONDS has no camera %s, keys are <garage>/<gate>/<lane>", key)
+		}
+	}
+	return nil
+}
+
+// cutLast slices s around the last instance of sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return body, true
+}
+
+// decodeStrict decodes body into value, rejecting keys value does not have so that a typo does
+// not go unnoticed
+func decodeStrict(body []byte, value any) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Println("Failed to write response: ", err)
+	}
+}
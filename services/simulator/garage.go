@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Garage the simulator models when the config lists none, the backend's default garage
+const defaultGarageId = "default"
+
+// One garage with its own capacity and gates
+type GARAGE struct {
+	ID       string `json:"ID"`
+	CAPACITY int    `json:"CAPACITY"`
+	// Overrides TRAFFIC.ARRIVALS_PER_HOUR for this garage when set
+	ARRIVALS_PER_HOUR float64 `json:"ARRIVALS_PER_HOUR"`
+	ENTRY_GATES       []GATE  `json:"ENTRY_GATES"`
+	EXIT_GATES        []GATE  `json:"EXIT_GATES"`
+}
+
+// Gate with LANES lanes, each with its own camera. Lanes are numbered from 1.
+type GATE struct {
+	ID    string `json:"ID"`
+	LANES int    `json:"LANES"`
+}
+
+// garages returns the configured garages, or a single garage with one entry and one exit gate
+// built from GARAGE_CAPACITY
+func (c CONFIG) garages() []GARAGE {
+	if len(c.GARAGES) > 0 {
+		return c.GARAGES
+	}
+	return []GARAGE{{
+		ID:          defaultGarageId,
+		CAPACITY:    c.GARAGE_CAPACITY,
+		ENTRY_GATES: []GATE{{ID: "entry", LANES: 1}},
+		EXIT_GATES:  []GATE{{ID: "exit", LANES: 1}},
+	}}
+}
+
+func validateGarages(garages []GARAGE) error {
+	ids := map[string]bool{}
+	for _, garage := range garages {
+		if garage.ID == "" {
+			return errors.New("every garage needs an ID")
+		}
+		if ids[garage.ID] {
+			return fmt.Errorf("garage %s is listed twice", garage.ID)
+		}
+		ids[garage.ID] = true
+		if garage.CAPACITY <= 0 {
+			return fmt.Errorf("garage %s needs a positive CAPACITY", garage.ID)
+		}
+		if len(garage.ENTRY_GATES) == 0 || len(garage.EXIT_GATES) == 0 {
+			return fmt.Errorf("garage %s needs at least one entry and one exit gate", garage.ID)
+		}
+		gates := map[string]bool{}
+		for _, gate := range append(append([]GATE{}, garage.ENTRY_GATES...), garage.EXIT_GATES...) {
+			if gate.ID == "" || gates[gate.ID] {
+				return fmt.Errorf("gates of garage %s need unique IDs", garage.ID)
+			}
+			gates[gate.ID] = true
+			if gate.LANES < 0 {
+				return fmt.Errorf("gate %s of garage %s has a negative number of lanes", gate.ID, garage.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// Where a camera saw a car
+type location struct {
+	garage string
+	gate   string
+	lane   string
+}
+
+// gateKey identifies the gate in GATE_DROP_RATES
+func (l location) gateKey() string {
+	return l.garage + "/" + l.gate
+}
+
+// cameraKey identifies the lane's camera in CAMERA_CLOCK_SKEW_SECONDS
+func (l location) cameraKey() string {
+	return l.gateKey() + "/" + l.lane
+}
+
+// gateLanes maps the key of every gate of garages to its number of lanes
+func gateLanes(garages []GARAGE) map[string]int {
+	lanes := map[string]int{}
+	for _, garage := range garages {
+		for _, gate := range append(append([]GATE{}, garage.ENTRY_GATES...), garage.EXIT_GATES...) {
+			lanes[location{garage: garage.ID, gate: gate.ID}.gateKey()] = max(gate.LANES, 1)
+		}
+	}
+	return lanes
+}
+
+// Cars inside one simulated garage. The mutex guards the cars and the settings the control API
+// changes at runtime: CAPACITY and ARRIVALS_PER_HOUR of config, the waits and the paused tolls.
+type garage struct {
+	config GARAGE
+	// Longest wait between cars of the tolls without TRAFFIC, in seconds
+	maxEntryWait int
+	maxExitWait  int
+	entryPaused  bool
+	exitPaused   bool
+
+	mutex      sync.Mutex
+	parkingLot []string
+}
+
+func newGarage(config GARAGE, maxEntryWait, maxExitWait int) *garage {
+	return &garage{config: config, maxEntryWait: maxEntryWait, maxExitWait: maxExitWait, parkingLot: []string{}}
+}
+
+// newGarages builds every garage of the config
+func newGarages(config CONFIG) []*garage {
+	garages := []*garage{}
+	for _, garageConfig := range config.garages() {
+		garages = append(garages, newGarage(garageConfig, config.MAX_ENTRY_WAIT, config.MAX_EXIT_WAIT))
+	}
+	return garages
+}
+
+func (g *garage) full() bool {
+	return len(g.parkingLot) >= g.config.CAPACITY
+}
+
+// entryLane picks the entry gate and lane the next car drives through
+func (g *garage) entryLane() location {
+	return g.lane(g.config.ENTRY_GATES)
+}
+
+// exitLane picks the exit gate and lane the next car leaves through
+func (g *garage) exitLane() location {
+	return g.lane(g.config.EXIT_GATES)
+}
+
+func (g *garage) lane(gates []GATE) location {
+	gate := gates[random.Intn(len(gates))]
+	lane := random.Intn(max(gate.LANES, 1)) + 1
+	return location{garage: g.config.ID, gate: gate.ID, lane: strconv.Itoa(lane)}
+}
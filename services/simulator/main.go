@@ -4,32 +4,52 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
 	"slices"
-	"sync"
+	"strconv"
+	"syscall"
 	"time"
 
-	"github.com/google/uuid"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"groundtruth"
+	"health"
 )
 
+// Wire format of event timestamps, the backend parses exactly this
+const eventTimeLayout = time.RFC3339Nano
+
 type CONFIG struct {
-	GARAGE_CAPACITY int `json:"GARAGE_CAPACITY"`
-	MAX_ENTRY_WAIT  int `json:"MAX_ENTRY_WAIT"`
-	MAX_EXIT_WAIT   int `json:"MAX_EXIT_WAIT"`
+	// Capacity of the single garage simulated when GARAGES is empty
+	GARAGE_CAPACITY int      `json:"GARAGE_CAPACITY"`
+	MAX_ENTRY_WAIT  int      `json:"MAX_ENTRY_WAIT"`
+	MAX_EXIT_WAIT   int      `json:"MAX_EXIT_WAIT"`
+	GARAGES         []GARAGE `json:"GARAGES"`
+	NOISE           NOISE    `json:"NOISE"`
+	CLOCK           CLOCK    `json:"CLOCK"`
+	TRAFFIC         TRAFFIC  `json:"TRAFFIC"`
+	// Seed of every random decision, zero picks one at startup
+	SEED int64 `json:"SEED"`
 }
 
 // Car registered at entrance toll
 // "id": <identifier for the event>,
 // "vehicle_plate": <alphanumeric registration id of the vehicle>,
-// "entry_date_time": <date time in UTC>
+// "entry_date_time": <date time in UTC>,
+// "garage_id", "gate_id", "lane_id": <where the camera is>
 type entryEvent struct {
 	Id            string `json:"id"`
 	VehiclePlate  string `json:"vehicle_plate"`
 	EntryDateTime string `json:"entry_date_time"`
+	GarageId      string `json:"garage_id,omitempty"`
+	GateId        string `json:"gate_id,omitempty"`
+	LaneId        string `json:"lane_id,omitempty"`
 }
 
 // Car registered at exit toll
@@ -37,10 +57,14 @@ type entryEvent struct {
 //	"id": <identifier for the event>,
 //	"vehicle_plate": <alphanumeric registration id of the vehicle>,
 //	"exit_date_time": <date time in UTC>,
+//	"garage_id", "gate_id", "lane_id": <where the camera is>
 type exitEvent struct {
 	Id           string `json:"id"`
 	VehiclePlate string `json:"vehicle_plate"`
 	ExitDateTime string `json:"exit_date_time"`
+	GarageId     string `json:"garage_id,omitempty"`
+	GateId       string `json:"gate_id,omitempty"`
+	LaneId       string `json:"lane_id,omitempty"`
 }
 type mqttWrapper interface {
 	publishEntryEvent([]byte)
@@ -48,135 +72,265 @@ type mqttWrapper interface {
 }
 
 func main() {
-	rabbitmqHost := os.Getenv("RABBITMQ_HOST")
-	rabbitmqPort := os.Getenv("RABBITMQ_PORT")
-	if rabbitmqHost == "" || rabbitmqPort == "" {
-		log.Fatalf("RABBITMQ_HOST and RABBITMQ_PORT must be set")
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(health.RunHealthcheck("simulator", os.Args[2:], os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "scenario" {
+		os.Exit(runScenarioCommand(os.Args[2:]))
 	}
-	rabbitmqURL := fmt.Sprintf("amqp://guest:guest@%s:%s/", rabbitmqHost, rabbitmqPort)
 
-	rabbitmq, err := newRabbitClient(rabbitmqURL)
+	shutdownTracing, err := setupTracing("simulator")
 	if err != nil {
-		log.Fatalf("Failed to create RabbitMQ client: %s", err)
+		log.Fatalf("Failed to set up tracing: %s", err)
 	}
+	defer shutdownTracing(context.Background())
 
-	defer rabbitmq.conn.Close()
-	defer rabbitmq.ch.Close()
-
-	noise := realNoise{}
+	if path := os.Getenv("GROUND_TRUTH_PATH"); path != "" {
+		if err := truth.open(path); err != nil {
+			log.Fatalf("Failed to open ground truth: %s", err)
+		}
+	}
 
 	config := loadConfig()
+	log.Printf("Using seed %d", seedRandom(config.SEED))
+	clock, err := newVirtualClock(config.CLOCK)
+	if err != nil {
+		log.Fatalf("Failed to set up the clock: %s", err)
+	}
+	if clock.speed != 1 {
+		log.Printf("Simulating from %s at %gx real time", clock.start.UTC().Format(time.RFC3339), clock.speed)
+	}
 
-	runServices(noise, &rabbitmq, config)
-
-	// Run endlessly
-	select {}
-}
+	steps := &stepClock{clocker: clock}
+	sink, healthHandler, err := newSink(os.Getenv("EVENT_SINK"), steps)
+	if err != nil {
+		log.Fatalf("Failed to set up the event sink: %s", err)
+	}
 
-func runServices(noise randomNoiser, mqtt mqttWrapper, config CONFIG) {
-	mutex := &sync.Mutex{}
-	parkingLot := []string{}
+	httpPort := os.Getenv("HTTP_PORT")
+	if httpPort == "" {
+		httpPort = "8084"
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	healthHandler.Register(mux)
+
+	cameras := &cameraNoise{config: config.NOISE, next: sink, clock: steps}
+	garages := newGarages(config)
+	// The control API changes the simulation, so it is only served with a token to check
+	if token := os.Getenv("CONTROL_TOKEN"); token != "" {
+		control := &controlAPI{garages: garages, cameras: cameras, clock: steps, token: token}
+		control.register(mux)
+	} else {
+		log.Println("CONTROL_TOKEN is not set, the control API is disabled")
+	}
 
-	go enterTollSimulator(noise, mutex, &parkingLot, mqtt, config)
-	go exitTollSimulator(mutex, &parkingLot, mqtt, config)
-}
+	go func() {
+		log.Fatalln("HTTP server stopped: ", http.ListenAndServe(":"+httpPort, mux))
+	}()
 
-func enterTollSimulator(randomNoise randomNoiser, mutex *sync.Mutex, parkingLot *[]string, mqtt mqttWrapper, config CONFIG) {
-	for {
-		time.Sleep(time.Duration(rand.Intn(config.MAX_ENTRY_WAIT)+1) * time.Second)
+	runServices(cameras, cameras, steps, clock.start, config, garages)
 
-		mutex.Lock()
+	// Run until stopped, and publish the exit held back for reordering rather than lose it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	cameras.flush()
+}
 
-		// Let car in if there is space
-		if len(*parkingLot) < config.GARAGE_CAPACITY {
-			enterTollFunc(randomNoise, parkingLot, mqtt)
+// newSink builds the sink EVENT_SINK names and the health checks that go with it. Only RabbitMQ
+// has dependencies, the offline sinks are always ready.
+func newSink(kind string, clock clocker) (mqttWrapper, *health.Handler, error) {
+	offline := &health.Handler{Live: func() error { return nil }}
+	switch kind {
+	case "", "rabbitmq":
+		url, err := rabbitmqURLFromEnv()
+		if err != nil {
+			return nil, nil, err
+		}
+		outbox, err := loadOutbox(os.Getenv("OUTBOX_PATH"), getEnvInt("OUTBOX_CAPACITY", 1000))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load outbox: %w", err)
+		}
+		rabbitmq := newRabbitClient(url, outbox)
+		go rabbitmq.run()
+		return rabbitmq, &health.Handler{
+			Live: rabbitmq.live,
+			Checks: []health.Check{
+				{Name: "amqp", Check: rabbitmq.ready},
+				// Events are buffered while the broker blocks publishing
+				{Name: "amqp-flow", Optional: true, Check: rabbitmq.flowControl},
+			},
+		}, nil
+	case "file":
+		path := os.Getenv("EVENT_FILE_PATH")
+		if path == "" {
+			return nil, nil, errors.New("EVENT_FILE_PATH must be set for the file sink")
+		}
+		sink, err := newFileSink(path, clock)
+		if err != nil {
+			return nil, nil, err
 		}
-		mutex.Unlock()
+		log.Printf("Writing events to %s", path)
+		return sink, offline, nil
+	case "stdout":
+		// Logs go to stderr, so stdout carries nothing but events
+		return &ndjsonSink{clock: clock, out: os.Stdout}, offline, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown EVENT_SINK %q, expected rabbitmq, file or stdout", kind)
 	}
 }
 
-func enterTollFunc(randomNoise randomNoiser, parkingLot *[]string, mqtt mqttWrapper) {
-	// Randomly generate a car
-	vehiclePlate := generateVehiclePlate()
-	*parkingLot = append(*parkingLot, vehiclePlate)
-
-	// Random noise that potentially blocks the toll registering the car and not sending the MQTT message
-	if randomNoise.noise() {
-		entryEvent := entryEvent{uuid.New().String(), vehiclePlate, time.Now().UTC().String()}
-		log.Println("incoming:", entryEvent)
-		body, err := json.Marshal(entryEvent)
-		if err != nil {
-			log.Println("Failed to marshal entry-event", err)
+func runServices(noise randomNoiser, mqtt mqttWrapper, clock *stepClock, start time.Time, config CONFIG, garages []*garage) {
+	if config.TRAFFIC.enabled() {
+		traffic := &trafficSimulator{
+			config:  config.TRAFFIC,
+			garages: garages,
+			noise:   noise,
+			mqtt:    mqtt,
+			clock:   clock,
+			start:   start,
 		}
-
-		mqtt.publishEntryEvent(body)
+		go traffic.run()
+		return
 	}
+	go newTollSimulator(noise, mqtt, clock, start, garages).run()
+}
 
+// Entry or exit toll of a garage without TRAFFIC, which lets a car through every 1 to
+// MAX_ENTRY_WAIT or MAX_EXIT_WAIT seconds
+type toll struct {
+	garage *garage
+	exit   bool
+	// Source of the toll's waits and of which car leaves, seeded from the simulation's source
+	random *rand.Rand
+	next   time.Time
 }
 
-func exitTollSimulator(mutex *sync.Mutex, parkingLot *[]string, mqtt mqttWrapper, config CONFIG) {
-	for {
-		time.Sleep(time.Duration(rand.Intn(config.MAX_EXIT_WAIT)+1) * time.Second)
+// wait draws the time until the toll lets the next car through
+func (t *toll) wait() time.Duration {
+	t.garage.mutex.Lock()
+	wait := t.garage.maxEntryWait
+	if t.exit {
+		wait = t.garage.maxExitWait
+	}
+	t.garage.mutex.Unlock()
+	return time.Duration(t.random.Intn(wait)+1) * time.Second
+}
 
-		mutex.Lock()
+// Drives the entry and exit tolls of all garages without TRAFFIC. Like trafficSimulator a single
+// loop runs every toll in the order of simulated time, so that a seeded run stays reproducible.
+type tollSimulator struct {
+	noise randomNoiser
+	mqtt  mqttWrapper
+	clock *stepClock
+	tolls []*toll
+}
 
-		// Let car out if there is a car in the parking lot
-		if len(*parkingLot) > 0 {
-			exitTollFunc(parkingLot, mqtt)
+// newTollSimulator sets up the entry and exit toll of every garage, their first cars come through
+// within the waits after start
+func newTollSimulator(noise randomNoiser, mqtt mqttWrapper, clock *stepClock, start time.Time, garages []*garage) *tollSimulator {
+	s := &tollSimulator{noise: noise, mqtt: mqtt, clock: clock}
+	for _, garage := range garages {
+		for _, exit := range []bool{false, true} {
+			toll := &toll{garage: garage, exit: exit, random: rand.New(rand.NewSource(random.Int63()))}
+			toll.next = start.Add(toll.wait())
+			s.tolls = append(s.tolls, toll)
 		}
-		mutex.Unlock()
 	}
+	return s
 }
 
-func exitTollFunc(parkingLot *[]string, mqtt mqttWrapper) {
-	carIndex := rand.Intn(len(*parkingLot))
-
-	exitEvent := exitEvent{uuid.New().String(), (*parkingLot)[carIndex], time.Now().UTC().String()}
-	*parkingLot = slices.Delete(*parkingLot, carIndex, carIndex+1)
+func (s *tollSimulator) run() {
+	for {
+		s.step()
+	}
+}
 
-	log.Println("outgoing:", exitEvent)
-	body, err := json.Marshal(exitEvent)
-	if err != nil {
-		log.Println("Failed to marshal exit-event", err)
+// step waits for the toll due first and lets a car through it, an entry if the garage has space
+// and an exit if it has cars
+func (s *tollSimulator) step() {
+	toll := s.tolls[0]
+	for _, other := range s.tolls[1:] {
+		if other.next.Before(toll.next) {
+			toll = other
+		}
 	}
+	s.clock.step(toll.next, func() {
+		garage := toll.garage
+		garage.mutex.Lock()
+		defer garage.mutex.Unlock()
+		switch {
+		case toll.exit && !garage.exitPaused && len(garage.parkingLot) > 0:
+			exitCar(garage, toll.random.Intn(len(garage.parkingLot)), s.mqtt, s.clock)
+		case !toll.exit && !garage.entryPaused && !garage.full():
+			enterTollFunc(s.noise, garage, s.mqtt, s.clock)
+		}
+	})
+	toll.next = toll.next.Add(toll.wait())
+}
 
-	mqtt.publishExitEvent(body)
+// enterTollFunc lets a new car into the garage through one of its entry lanes and returns its plate
+func enterTollFunc(randomNoise randomNoiser, garage *garage, mqtt mqttWrapper, clock clocker) string {
+	// Randomly generate a car
+	vehiclePlate := generateVehiclePlate()
+	enterCar(randomNoise, garage, vehiclePlate, mqtt, clock)
+	return vehiclePlate
 }
 
-func (r *rabbitmqWrapper) publishEntryEvent(body []byte) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// enterCar lets the car with vehiclePlate into the garage through one of its entry lanes
+func enterCar(randomNoise randomNoiser, garage *garage, vehiclePlate string, mqtt mqttWrapper, clock clocker) {
+	garage.parkingLot = append(garage.parkingLot, vehiclePlate)
 
-	err := r.ch.PublishWithContext(ctx,
-		"",            // exchange
-		r.entryQ.Name, // routing key
-		false,         // mandatory
-		false,         // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        body,
+	// Random noise that potentially blocks the toll registering the car and not sending the MQTT message
+	at := garage.entryLane()
+	entryEvent := entryEvent{
+		Id:            newEventId(),
+		VehiclePlate:  vehiclePlate,
+		EntryDateTime: clock.now().UTC().Format(eventTimeLayout),
+		GarageId:      at.garage,
+		GateId:        at.gate,
+		LaneId:        at.lane,
+	}
+	if !randomNoise.noise(at) {
+		truth.record(groundtruth.Record{
+			Event: "entry", EventId: entryEvent.Id, Plate: vehiclePlate, Time: entryEvent.EntryDateTime,
+			GarageId: at.garage, GateId: at.gate, LaneId: at.lane, Faults: []string{faultDropped},
 		})
+		return
+	}
+	log.Println("incoming:", entryEvent)
+	body, err := json.Marshal(entryEvent)
 	if err != nil {
-		log.Println("Failed to publish entry-event", err)
+		log.Println("Failed to marshal entry-event", err)
 	}
+
+	mqtt.publishEntryEvent(body)
 }
 
-func (r *rabbitmqWrapper) publishExitEvent(body []byte) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// exitCar lets the car at carIndex out through one of the garage's exit lanes
+func exitCar(garage *garage, carIndex int, mqtt mqttWrapper, clock clocker) {
+	at := garage.exitLane()
+	exitEvent := exitEvent{
+		Id:           newEventId(),
+		VehiclePlate: garage.parkingLot[carIndex],
+		ExitDateTime: clock.now().UTC().Format(eventTimeLayout),
+		GarageId:     at.garage,
+		GateId:       at.gate,
+		LaneId:       at.lane,
+	}
+	garage.parkingLot = slices.Delete(garage.parkingLot, carIndex, carIndex+1)
 
-	err := r.ch.PublishWithContext(ctx,
-		"",           // exchange
-		r.exitQ.Name, // routing key
-		false,        // mandatory
-		false,        // immediate
-		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        body,
-		})
+	log.Println("outgoing:", exitEvent)
+	body, err := json.Marshal(exitEvent)
 	if err != nil {
-		log.Println("Failed to publish exit-event", err)
+		log.Println("Failed to marshal exit-event", err)
 	}
+
+	mqtt.publishExitEvent(body)
 }
 
 func generateVehiclePlate() string {
@@ -185,29 +339,15 @@ func generateVehiclePlate() string {
 
 	plate := make([]byte, 6)
 	for i := 0; i < 3; i++ {
-		plate[i] = letters[rand.Intn(len(letters))]
+		plate[i] = letters[random.Intn(len(letters))]
 	}
 	for i := 3; i < 6; i++ {
-		plate[i] = numbers[rand.Intn(len(numbers))]
+		plate[i] = numbers[random.Intn(len(numbers))]
 	}
 
 	return string(plate)
 }
 
-// 6. 80% of the exit events generated should match a vehicle plate that has a corresponding entry event.
-// Remianing exit events should have no correspnding entry events.
-// This is to simulate the case where the mall camera did not record vehicle entry event,
-// perhaps because one or more of the vehicle plates were not clean/clear enough!
-type randomNoiser interface {
-	noise() bool
-}
-
-type realNoise struct{}
-
-func (r realNoise) noise() bool {
-	return rand.Intn(100) < 80
-}
-
 func loadConfig() CONFIG {
 	configFile, err := os.Open("config/config.json")
 	if err != nil {
@@ -215,11 +355,35 @@ func loadConfig() CONFIG {
 	}
 	defer configFile.Close()
 
-	var config CONFIG
+	config := CONFIG{NOISE: defaultNoise()}
 	err = json.NewDecoder(configFile).Decode(&config)
 	if err != nil {
 		log.Fatalf("Failed to decode config file: %s", err)
 	}
+	if err := validateGarages(config.garages()); err != nil {
+		log.Fatalf("Invalid GARAGES config: %s", err)
+	}
+	if err := config.NOISE.validate(gateLanes(config.garages())); err != nil {
+		log.Fatalf("Invalid NOISE config: %s", err)
+	}
+	if config.TRAFFIC.enabled() {
+		if err := config.TRAFFIC.validate(); err != nil {
+			log.Fatalf("Invalid TRAFFIC config: %s", err)
+		}
+	}
 
 	return config
 }
+
+// getEnvInt reads an optional integer setting, falling back to def when it is not set
+func getEnvInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("%s must be an integer: %s", name, err)
+	}
+	return parsed
+}
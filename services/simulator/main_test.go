@@ -1,10 +1,30 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"groundtruth"
+)
 
 type mockNoise struct{}
 
-func (m mockNoise) noise() bool {
+func (m mockNoise) noise(at location) bool {
 	return true
 }
 
@@ -13,23 +33,58 @@ type mockMqtt struct{}
 func (m mockMqtt) publishEntryEvent([]byte) {}
 func (m mockMqtt) publishExitEvent([]byte)  {}
 
+type recordingMqtt struct {
+	entries, exits [][]byte
+}
+
+func (r *recordingMqtt) publishEntryEvent(body []byte) { r.entries = append(r.entries, body) }
+func (r *recordingMqtt) publishExitEvent(body []byte)  { r.exits = append(r.exits, body) }
+
+// Clock that only moves when slept on
+type manualClock struct {
+	mutex   sync.Mutex
+	current time.Time
+}
+
+func (c *manualClock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.current
+}
+
+func (c *manualClock) sleep(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.current = c.current.Add(d)
+}
+
+func testGarage(id string, capacity int) *garage {
+	return newGarage(GARAGE{
+		ID:          id,
+		CAPACITY:    capacity,
+		ENTRY_GATES: []GATE{{ID: id + "-in", LANES: 2}},
+		EXIT_GATES:  []GATE{{ID: id + "-out", LANES: 1}},
+	}, 1, 1)
+}
+
 func TestEnterTollFunc(t *testing.T) {
 	mockNoise := mockNoise{}
 	mockMqtt := mockMqtt{}
-	parkingLot := []string{}
-	enterTollFunc(mockNoise, &parkingLot, mockMqtt)
+	garage := testGarage("north", 10)
+	enterTollFunc(mockNoise, garage, mockMqtt, &manualClock{})
 
-	if len(parkingLot) == 0 {
+	if len(garage.parkingLot) == 0 {
 		t.Errorf("Expected parkingLot to have a car")
 	}
 }
 
-func TestExitTollFunc(t *testing.T) {
+func TestExitCar(t *testing.T) {
 	mockMqtt := mockMqtt{}
-	parkingLot := []string{"ABC123"}
-	exitTollFunc(&parkingLot, mockMqtt)
+	garage := testGarage("north", 10)
+	garage.parkingLot = []string{"ABC123"}
+	exitCar(garage, 0, mockMqtt, &manualClock{})
 
-	if len(parkingLot) != 0 {
+	if len(garage.parkingLot) != 0 {
 		t.Errorf("Expected parkingLot to be empty")
 	}
 }
@@ -40,3 +95,676 @@ func TestLoadConfig(t *testing.T) {
 		t.Errorf("Expected non-zero values for GARAGE_CAPACITY, MAX_ENTRY_WAIT, and MAX_EXIT_WAIT")
 	}
 }
+
+func TestEventTimestamps(t *testing.T) {
+	mqtt := &recordingMqtt{}
+	garage := testGarage("north", 10)
+	clock := &manualClock{current: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)}
+	enterTollFunc(mockNoise{}, garage, mqtt, clock)
+	clock.sleep(90 * time.Minute)
+	exitCar(garage, 0, mqtt, clock)
+
+	entry := entryEvent{}
+	if err := json.Unmarshal(mqtt.entries[0], &entry); err != nil {
+		t.Fatal(err)
+	}
+	exit := exitEvent{}
+	if err := json.Unmarshal(mqtt.exits[0], &exit); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{entry.EntryDateTime, exit.ExitDateTime} {
+		if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+			t.Errorf("Expected an RFC 3339 timestamp, got %q", value)
+		}
+	}
+	if entry.EntryDateTime != "2024-01-01T10:00:00Z" || exit.ExitDateTime != "2024-01-01T11:30:00Z" {
+		t.Errorf("Expected timestamps from the clock, got %s and %s", entry.EntryDateTime, exit.ExitDateTime)
+	}
+	if entry.GarageId != "north" || entry.GateId != "north-in" || (entry.LaneId != "1" && entry.LaneId != "2") {
+		t.Errorf("Expected the entry at a lane of north-in, got %+v", entry)
+	}
+	if exit.GarageId != "north" || exit.GateId != "north-out" || exit.LaneId != "1" {
+		t.Errorf("Expected the exit at north-out, got %+v", exit)
+	}
+}
+
+func TestVirtualClock(t *testing.T) {
+	clock, err := newVirtualClock(CLOCK{SPEED: 36000, START_TIME: "2024-01-01T00:00:00Z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	clock.sleep(time.Hour)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected an hour to pass in a tenth of a second, took %s", elapsed)
+	}
+	now := clock.now()
+	if now.Before(time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)) || now.After(time.Date(2024, 1, 1, 1, 30, 0, 0, time.UTC)) {
+		t.Errorf("Expected the clock at about 01:00, got %s", now)
+	}
+
+	if _, err := newVirtualClock(CLOCK{START_TIME: "yesterday"}); err == nil {
+		t.Errorf("Expected an invalid start time to fail")
+	}
+}
+
+func TestStartPublishSpan(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	span, headers := startPublishSpan("entry-event")
+	defer span.End()
+
+	traceparent, _ := headers["traceparent"].(string)
+	if !strings.Contains(traceparent, span.SpanContext().TraceID().String()) {
+		t.Errorf("Expected the headers to carry the publish span, got %q", traceparent)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	outbox, err := loadOutbox(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rabbitmq := newRabbitClient("", outbox)
+	rabbitmq.publishEntryEvent([]byte(`{"id":"1"}`))
+	rabbitmq.publishExitEvent([]byte(`{"id":"2"}`))
+	rabbitmq.publishExitEvent([]byte(`{"id":"3"}`))
+	if outbox.len() != 2 {
+		t.Fatalf("Expected the full outbox to drop the third event, got %d", outbox.len())
+	}
+
+	entries := outbox.unpublished(time.Now())
+	outbox.published(entries[0], 1)
+	outbox.published(entries[1], 2)
+	outbox.settle(amqp.Confirmation{DeliveryTag: 1, Ack: true}, time.Second)
+	outbox.settle(amqp.Confirmation{DeliveryTag: 2, Ack: false}, time.Second)
+	if outbox.len() != 1 {
+		t.Errorf("Expected only the nacked event to remain, got %d", outbox.len())
+	}
+	if len(outbox.unpublished(time.Now())) != 0 || len(outbox.unpublished(time.Now().Add(time.Second))) != 1 {
+		t.Errorf("Expected the nacked event to be published again after the retry delay")
+	}
+
+	// A restarted simulator replays what was never confirmed
+	reloaded, err := loadOutbox(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := reloaded.unpublished(time.Now())
+	if len(replay) != 1 || replay[0].Queue != exitQueueName || string(replay[0].Body) != `{"id":"2"}` {
+		t.Errorf("Expected the unconfirmed exit event on disk, got %+v", replay)
+	}
+
+	// Loading compacts the log to the events left, and a line cut short by a crash is ignored
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(saved, []byte("\n")); lines != 1 {
+		t.Errorf("Expected the compacted log to hold one event, got %d lines", lines)
+	}
+	if err := os.WriteFile(path, append(saved, `{"id":"4","que`...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err = loadOutbox(path, 2)
+	if err != nil || reloaded.len() != 1 {
+		t.Errorf("Expected the torn line to be ignored, got %v", err)
+	}
+}
+
+func TestCameraNoise(t *testing.T) {
+	mqtt := &recordingMqtt{}
+	cameras := &cameraNoise{next: mqtt, config: NOISE{MISREAD_RATE: 1, DUPLICATE_RATE: 1, ENTRY_CLOCK_SKEW_SECONDS: -2}}
+	body, _ := json.Marshal(entryEvent{Id: "1", VehiclePlate: "ABC123", EntryDateTime: "2024-01-01T10:00:00Z"})
+	cameras.publishEntryEvent(body)
+
+	if len(mqtt.entries) != 2 || string(mqtt.entries[0]) != string(mqtt.entries[1]) {
+		t.Fatalf("Expected the entry to be published twice, got %q", mqtt.entries)
+	}
+	entry := entryEvent{}
+	if err := json.Unmarshal(mqtt.entries[0], &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.EntryDateTime != "2024-01-01T09:59:58Z" {
+		t.Errorf("Expected the entry clock to be 2s behind, got %s", entry.EntryDateTime)
+	}
+	differences := 0
+	for i := range entry.VehiclePlate {
+		if entry.VehiclePlate[i] != "ABC123"[i] {
+			differences++
+			if !strings.ContainsRune(ocrConfusions["ABC123"[i]], rune(entry.VehiclePlate[i])) {
+				t.Errorf("Expected an OCR confusion of %c, got %c", "ABC123"[i], entry.VehiclePlate[i])
+			}
+		}
+	}
+	if differences != 1 {
+		t.Errorf("Expected one misread character, got %s", entry.VehiclePlate)
+	}
+
+	// The first exit is held back and published after the second
+	mqtt = &recordingMqtt{}
+	clock := &stepClock{clocker: &manualClock{current: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)}}
+	cameras = &cameraNoise{next: mqtt, config: NOISE{OUT_OF_ORDER_RATE: 1}, clock: clock}
+	for _, id := range []string{"1", "2"} {
+		body, _ := json.Marshal(exitEvent{Id: id, VehiclePlate: "ABC123", ExitDateTime: "2024-01-01T10:00:00Z"})
+		cameras.publishExitEvent(body)
+	}
+	ids := []string{}
+	for _, body := range mqtt.exits {
+		exit := exitEvent{}
+		json.Unmarshal(body, &exit)
+		ids = append(ids, exit.Id)
+	}
+	if strings.Join(ids, ",") != "2,1" {
+		t.Errorf("Expected the exits out of order, got %v", ids)
+	}
+
+	// An exit no other exit follows is published once it was held for maxExitHold
+	mqtt = &recordingMqtt{}
+	cameras = &cameraNoise{next: mqtt, config: NOISE{OUT_OF_ORDER_RATE: 1}, clock: clock}
+	body, _ = json.Marshal(exitEvent{Id: "3", VehiclePlate: "ABC123", ExitDateTime: "2024-01-01T10:00:00Z"})
+	cameras.publishExitEvent(body)
+	clock.runTimers(clock.now().Add(maxExitHold - time.Second))
+	if len(mqtt.exits) != 0 {
+		t.Fatalf("Expected the exit to be held, got %q", mqtt.exits)
+	}
+	clock.runTimers(clock.now().Add(maxExitHold))
+	if len(mqtt.exits) != 1 || !bytes.Equal(mqtt.exits[0], body) {
+		t.Errorf("Expected the held exit to be published after %s, got %q", maxExitHold, mqtt.exits)
+	}
+	// The timer of an exit released by the next one publishes nothing
+	mqtt.exits = nil
+	cameras.publishExitEvent(body)
+	cameras.config.OUT_OF_ORDER_RATE = 0
+	cameras.publishExitEvent(body)
+	clock.runTimers(time.Time{})
+	if len(mqtt.exits) != 2 {
+		t.Errorf("Expected each exit published once, got %d", len(mqtt.exits))
+	}
+
+	mqtt = &recordingMqtt{}
+	cameras = &cameraNoise{next: mqtt, config: NOISE{EXIT_DROP_RATE: 1}}
+	body, _ = json.Marshal(exitEvent{Id: "4", VehiclePlate: "ABC123", ExitDateTime: "2024-01-01T10:00:00Z"})
+	cameras.publishExitEvent(body)
+	if len(mqtt.exits) != 0 {
+		t.Errorf("Expected the exit to be dropped")
+	}
+
+	// Gates and cameras with settings of their own override the ones by toll kind
+	mqtt = &recordingMqtt{}
+	cameras = &cameraNoise{next: mqtt, config: NOISE{
+		ENTRY_DROP_RATE:           1,
+		EXIT_DROP_RATE:            1,
+		EXIT_CLOCK_SKEW_SECONDS:   5,
+		GATE_DROP_RATES:           map[string]float64{"north/in": 0, "north/out": 0},
+		CAMERA_CLOCK_SKEW_SECONDS: map[string]float64{"north/out/2": -2},
+	}}
+	if !cameras.noise(location{garage: "north", gate: "in", lane: "1"}) || cameras.noise(location{garage: "north", gate: "in2", lane: "1"}) {
+		t.Errorf("Expected only the entry gate without a drop rate of its own to miss the vehicle")
+	}
+	for _, lane := range []string{"1", "2"} {
+		body, _ = json.Marshal(exitEvent{Id: lane, VehiclePlate: "ABC123", ExitDateTime: "2024-01-01T10:00:00Z", GarageId: "north", GateId: "out", LaneId: lane})
+		cameras.publishExitEvent(body)
+	}
+	times := []string{}
+	for _, body := range mqtt.exits {
+		exit := exitEvent{}
+		json.Unmarshal(body, &exit)
+		times = append(times, exit.ExitDateTime)
+	}
+	if strings.Join(times, ",") != "2024-01-01T10:00:05Z,2024-01-01T09:59:58Z" {
+		t.Errorf("Expected lane 1 at the exit skew and lane 2 at its own, got %v", times)
+	}
+}
+
+func TestTrafficSimulator(t *testing.T) {
+	config := loadConfig().TRAFFIC
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	// Monday
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &manualClock{current: start}
+	mqtt := &recordingMqtt{}
+	traffic := &trafficSimulator{
+		config:  config,
+		garages: []*garage{testGarage("north", 1000)},
+		noise:   mockNoise{},
+		mqtt:    mqtt,
+		clock:   &stepClock{clocker: clock},
+		start:   start,
+	}
+	for clock.now().Before(start.Add(24 * time.Hour)) {
+		traffic.step()
+	}
+
+	expected := 0.0
+	for hour := 0; hour < 24; hour++ {
+		expected += config.rate(start.Add(time.Duration(hour)*time.Hour + 30*time.Minute))
+	}
+	if arrivals := float64(len(mqtt.entries)); arrivals < expected*0.6 || arrivals > expected*1.4 {
+		t.Errorf("Expected about %.0f arrivals in a day, got %.0f", expected, arrivals)
+	}
+
+	entered := map[string]time.Time{}
+	night, peak := 0, 0
+	for _, body := range mqtt.entries {
+		entry := entryEvent{}
+		json.Unmarshal(body, &entry)
+		at, _ := time.Parse(time.RFC3339Nano, entry.EntryDateTime)
+		entered[entry.VehiclePlate] = at
+		switch {
+		case at.Hour() < 6:
+			night++
+		case at.Hour() >= 12 && at.Hour() < 18:
+			peak++
+		}
+	}
+	if peak <= night*5 {
+		t.Errorf("Expected far more arrivals in the afternoon than at night, got %d and %d", peak, night)
+	}
+	for _, body := range mqtt.exits {
+		exit := exitEvent{}
+		json.Unmarshal(body, &exit)
+		at, _ := time.Parse(time.RFC3339Nano, exit.ExitDateTime)
+		if at.Before(entered[exit.VehiclePlate]) || at.Sub(entered[exit.VehiclePlate]) > 12*time.Hour {
+			t.Errorf("Expected %s to leave within its dwell time, entered %s and left %s", exit.VehiclePlate, entered[exit.VehiclePlate], at)
+		}
+	}
+}
+
+func TestDwellHistogram(t *testing.T) {
+	dwell := DWELL{DISTRIBUTION: "histogram", HISTOGRAM: []DWELL_BUCKET{{MINUTES: 30, WEIGHT: 0}, {MINUTES: 60, WEIGHT: 1}}}
+	if err := (TRAFFIC{ARRIVALS_PER_HOUR: 1, DWELL: dwell}).validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if stay := dwell.dwell(); stay < 30*time.Minute || stay > 60*time.Minute {
+			t.Fatalf("Expected stays between 30 and 60 minutes, got %s", stay)
+		}
+	}
+
+	if err := (TRAFFIC{ARRIVALS_PER_HOUR: 1, HOURLY_PROFILE: []float64{1}, DWELL: dwell}).validate(); err == nil {
+		t.Errorf("Expected an hourly profile without 24 values to fail")
+	}
+}
+
+func TestGarages(t *testing.T) {
+	if err := validateGarages((CONFIG{GARAGE_CAPACITY: 10}).garages()); err != nil {
+		t.Errorf("Expected the default garage to be valid, got %s", err)
+	}
+	north := testGarage("north", 10).config
+	if err := validateGarages([]GARAGE{north, north}); err == nil {
+		t.Errorf("Expected a garage listed twice to fail")
+	}
+	if err := validateGarages([]GARAGE{{ID: "south", CAPACITY: 10, ENTRY_GATES: []GATE{{ID: "in"}}}}); err == nil {
+		t.Errorf("Expected a garage without exit gates to fail")
+	}
+
+	config := loadConfig().TRAFFIC
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	clock := &manualClock{current: start}
+	mqtt := &recordingMqtt{}
+	small := testGarage("small", 2)
+	small.config.ARRIVALS_PER_HOUR = config.ARRIVALS_PER_HOUR * 4
+	traffic := &trafficSimulator{
+		config:  config,
+		garages: []*garage{testGarage("large", 1000), small},
+		noise:   mockNoise{},
+		mqtt:    mqtt,
+		clock:   &stepClock{clocker: clock},
+		start:   start,
+	}
+	for clock.now().Before(start.Add(8 * time.Hour)) {
+		traffic.step()
+		if len(small.parkingLot) > 2 {
+			t.Fatalf("Expected the small garage to turn cars away once full, got %d cars", len(small.parkingLot))
+		}
+	}
+
+	entered := map[string]string{}
+	arrivals := map[string]int{}
+	for _, body := range mqtt.entries {
+		entry := entryEvent{}
+		json.Unmarshal(body, &entry)
+		entered[entry.VehiclePlate] = entry.GarageId
+		arrivals[entry.GarageId]++
+	}
+	if arrivals["large"] == 0 || arrivals["small"] == 0 {
+		t.Errorf("Expected arrivals at both garages, got %v", arrivals)
+	}
+	for _, body := range mqtt.exits {
+		exit := exitEvent{}
+		json.Unmarshal(body, &exit)
+		if exit.GarageId != entered[exit.VehiclePlate] {
+			t.Errorf("Expected %s to leave the garage it entered, %s, got %s", exit.VehiclePlate, entered[exit.VehiclePlate], exit.GarageId)
+		}
+	}
+}
+
+func TestSeededRun(t *testing.T) {
+	run := func(seed int64) [][]byte {
+		seedRandom(seed)
+		config := loadConfig()
+		start := time.Date(2024, 1, 6, 8, 0, 0, 0, time.UTC)
+		clock := &manualClock{current: start}
+		mqtt := &recordingMqtt{}
+		noise := config.NOISE
+		noise.DELAY_RATE = 0
+		steps := &stepClock{clocker: clock}
+		cameras := &cameraNoise{config: noise, next: mqtt, clock: steps}
+		traffic := &trafficSimulator{
+			config:  config.TRAFFIC,
+			garages: []*garage{testGarage("north", 100), testGarage("south", 50)},
+			noise:   cameras,
+			mqtt:    cameras,
+			clock:   steps,
+			start:   start,
+		}
+		for clock.now().Before(start.Add(6 * time.Hour)) {
+			traffic.step()
+		}
+		return append(mqtt.entries, mqtt.exits...)
+	}
+
+	first := run(42)
+	second := run(42)
+	if len(first) == 0 || !slices.EqualFunc(first, second, bytes.Equal) {
+		t.Errorf("Expected the same seed to reproduce the same %d events", len(first))
+	}
+	if other := run(43); slices.EqualFunc(first, other, bytes.Equal) {
+		t.Errorf("Expected another seed to produce other events")
+	}
+}
+
+func TestSeededDefaultRun(t *testing.T) {
+	run := func(seed int64) string {
+		seedRandom(seed)
+		clock, err := newVirtualClock(CLOCK{SPEED: 1e9, START_TIME: "2024-01-06T08:00:00Z"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		steps := &stepClock{clocker: clock}
+		out := &bytes.Buffer{}
+		noise := NOISE{ENTRY_DROP_RATE: 0.2, EXIT_DROP_RATE: 0.1, MISREAD_RATE: 0.1, DUPLICATE_RATE: 0.1, DELAY_RATE: 0.2, MAX_DELAY_SECONDS: 30, OUT_OF_ORDER_RATE: 0.1}
+		cameras := &cameraNoise{config: noise, next: &ndjsonSink{clock: steps, out: out}, clock: steps}
+		garages := []*garage{newGarage(testGarage("north", 20).config, 5, 10), newGarage(testGarage("south", 10).config, 5, 10)}
+		tolls := newTollSimulator(cameras, cameras, steps, clock.start, garages)
+		for range 500 {
+			tolls.step()
+		}
+		steps.runTimers(time.Time{})
+		return out.String()
+	}
+
+	first := run(42)
+	if !strings.Contains(first, `"exit-event"`) {
+		t.Fatalf("Expected entries and exits, got %q", first)
+	}
+	if second := run(42); second != first {
+		t.Errorf("Expected the same seed to reproduce a byte-identical event stream")
+	}
+	if other := run(43); other == first {
+		t.Errorf("Expected another seed to produce other events")
+	}
+}
+
+func TestGroundTruth(t *testing.T) {
+	out := &bytes.Buffer{}
+	truth.out = out
+	t.Cleanup(func() { truth.out = nil })
+
+	mqtt := &recordingMqtt{}
+	cameras := &cameraNoise{next: mqtt, config: NOISE{MISREAD_RATE: 1}}
+	garage := testGarage("north", 10)
+	clock := &manualClock{current: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)}
+	enterTollFunc(&cameraNoise{config: NOISE{ENTRY_DROP_RATE: 1}}, garage, cameras, clock)
+	exitCar(garage, 0, cameras, clock)
+
+	records := []groundtruth.Record{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		record := groundtruth.Record{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected an entry and an exit record, got %+v", records)
+	}
+	entry, exit := records[0], records[1]
+	if entry.Event != "entry" || !slices.Equal(entry.Faults, []string{faultDropped}) || entry.PublishedPlate != "" {
+		t.Errorf("Expected the dropped entry in the ground truth, got %+v", entry)
+	}
+	if exit.Event != "exit" || exit.Plate != entry.Plate || exit.PublishedPlate == exit.Plate || !slices.Equal(exit.Faults, []string{faultMisread}) {
+		t.Errorf("Expected the misread exit with its true plate, got %+v", exit)
+	}
+	if exit.Time != "2024-01-01T10:00:00Z" || exit.PublishedTime != exit.Time {
+		t.Errorf("Expected the exit time in the ground truth, got %+v", exit)
+	}
+	if entry.GarageId != "north" || entry.GateId != "north-in" || exit.GarageId != "north" || exit.GateId != "north-out" {
+		t.Errorf("Expected the garage and gates in the ground truth, got %+v and %+v", entry, exit)
+	}
+}
+
+func TestEventSinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	clock := &manualClock{current: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)}
+	sink, err := newFileSink(path, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.publishEntryEvent([]byte(`{"id":"1"}`))
+	clock.sleep(time.Minute)
+	sink.publishExitEvent([]byte(`{"id":"2"}`))
+
+	// The recording replays at the pace it was written at, scaled by the speed
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	slept := []time.Duration{}
+	replayed := []recordedEvent{}
+	count, err := replay(file, 4, func(d time.Duration) { slept = append(slept, d) }, func(event recordedEvent) {
+		replayed = append(replayed, event)
+	})
+	if err != nil || count != 2 {
+		t.Fatalf("Expected two replayed events, got %d: %v", count, err)
+	}
+	if replayed[0].Queue != entryQueueName || string(replayed[0].Body) != `{"id":"1"}` || replayed[1].Queue != exitQueueName {
+		t.Errorf("Expected the recorded events in order, got %+v", replayed)
+	}
+	if !slices.Equal(slept, []time.Duration{15 * time.Second}) {
+		t.Errorf("Expected a quarter of the recorded minute between the events, slept %v", slept)
+	}
+
+	if _, err := replay(strings.NewReader(`{"queue":"other","published_at":"2024-01-01T10:00:00Z","body":{}}`), 0, nil, func(recordedEvent) {}); err == nil {
+		t.Errorf("Expected an unknown queue to fail the replay")
+	}
+
+	events := make(chan recordedEvent, 1)
+	(&channelSink{clock: clock, events: events}).publishExitEvent([]byte(`{"id":"3"}`))
+	if event := <-events; event.Queue != exitQueueName || event.PublishedAt != "2024-01-01T10:01:00Z" {
+		t.Errorf("Expected the exit event on the channel, got %+v", event)
+	}
+}
+
+func TestControlAPI(t *testing.T) {
+	mqtt := &recordingMqtt{}
+	clock := &stepClock{clocker: &manualClock{current: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)}}
+	cameras := &cameraNoise{config: defaultNoise(), next: mqtt, clock: clock}
+	north := testGarage("north", 1)
+	mux := http.NewServeMux()
+	(&controlAPI{garages: []*garage{north}, cameras: cameras, clock: clock, token: "secret"}).register(mux)
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		mux.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	for _, authorization := range []string{"", "Bearer wrong", "secret"} {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("PATCH", "/control/noise", strings.NewReader(`{"ENTRY_DROP_RATE": 1}`))
+		req.Header.Set("Authorization", authorization)
+		mux.ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusUnauthorized || cameras.settings().ENTRY_DROP_RATE == 1 {
+			t.Errorf("Expected %q to be unauthorized, got %d", authorization, recorder.Code)
+		}
+	}
+
+	if recorder := request("PATCH", "/control/noise", `{"ENTRY_DROP_RATE": 0}`); recorder.Code != http.StatusOK || !reflect.DeepEqual(cameras.settings(), NOISE{MAX_DELAY_SECONDS: 30}) {
+		t.Errorf("Expected only the entry drop rate to change, got %d %+v", recorder.Code, cameras.settings())
+	}
+	if recorder := request("PATCH", "/control/noise", `{"MISREAD_RATE": 2}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected a rate above 1 to be rejected, got %d", recorder.Code)
+	}
+	if recorder := request("PATCH", "/control/noise", `{"GATE_DROP_RATES": {"north/north-out": 0.5}, "CAMERA_CLOCK_SKEW_SECONDS": {"north/north-in/2": -3}}`); recorder.Code != http.StatusOK || cameras.settings().GATE_DROP_RATES["north/north-out"] != 0.5 {
+		t.Errorf("Expected the gate and camera settings to be set, got %d %s", recorder.Code, recorder.Body)
+	}
+	for _, body := range []string{
+		`{"GATE_DROP_RATES": {"north/north-out": 1.5}}`,
+		`{"GATE_DROP_RATES": {"south/north-out": 0.5}}`,
+		`{"CAMERA_CLOCK_SKEW_SECONDS": {"north/north-in/3": 1}}`,
+		`{"CAMERA_CLOCK_SKEW_SECONDS": {"north/north-in": 1}}`,
+	} {
+		if recorder := request("PATCH", "/control/noise", body); recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", body, recorder.Code)
+		}
+	}
+	// A map in the body replaces the current one, leaving the other map alone
+	if recorder := request("PATCH", "/control/noise", `{"GATE_DROP_RATES": {}}`); recorder.Code != http.StatusOK || len(cameras.settings().GATE_DROP_RATES) != 0 || len(cameras.settings().CAMERA_CLOCK_SKEW_SECONDS) != 1 {
+		t.Errorf("Expected only the gate drop rates cleared, got %d %+v", recorder.Code, cameras.settings())
+	}
+	request("PATCH", "/control/noise", `{"CAMERA_CLOCK_SKEW_SECONDS": {}}`)
+	if recorder := request("PATCH", "/control/garages/north", `{"ENTRY_PAUSED": true, "CAPACITY": 2}`); recorder.Code != http.StatusOK || !north.entryPaused || north.config.CAPACITY != 2 || north.maxEntryWait != 1 {
+		t.Errorf("Expected the entry toll paused and the capacity raised, got %d %+v", recorder.Code, north.settings())
+	}
+	if recorder := request("PATCH", "/control/garages/north", `{"CAPACTY": 3}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown setting to be rejected, got %d", recorder.Code)
+	}
+	for _, body := range []string{`{"ID": "south"}`, `{"OCCUPIED": 0}`} {
+		if recorder := request("PATCH", "/control/garages/north", body); recorder.Code != http.StatusBadRequest || north.config.ID != "north" {
+			t.Errorf("Expected the read-only %s to be rejected, got %d", body, recorder.Code)
+		}
+	}
+	if recorder := request("PATCH", "/control/garages/south", `{}`); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown garage to be rejected, got %d", recorder.Code)
+	}
+
+	// Scripted cars go through while the toll is paused
+	if recorder := request("POST", "/control/garages/north/entries", `{"VEHICLE_PLATE": "ABC123"}`); recorder.Code != http.StatusNoContent {
+		t.Fatalf("Expected the scripted entry, got %d %s", recorder.Code, recorder.Body)
+	}
+	if recorder := request("POST", "/control/garages/north/entries", `{"VEHICLE_PLATE": "ABC123"}`); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected a car already inside to be rejected, got %d", recorder.Code)
+	}
+	recorder := request("GET", "/control/garages/north/cars", "")
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"CARS":["ABC123"]`) {
+		t.Errorf("Expected the scripted car in the parking lot, got %d %s", recorder.Code, recorder.Body)
+	}
+	if recorder := request("POST", "/control/garages/north/exits", `{"VEHICLE_PLATE": "XYZ999"}`); recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected a car that is not inside to be rejected, got %d", recorder.Code)
+	}
+	if recorder := request("POST", "/control/garages/north/exits", `{"VEHICLE_PLATE": "ABC123"}`); recorder.Code != http.StatusNoContent {
+		t.Errorf("Expected the scripted exit, got %d %s", recorder.Code, recorder.Body)
+	}
+	if len(mqtt.entries) != 1 || len(mqtt.exits) != 1 || !strings.Contains(string(mqtt.exits[0]), `"vehicle_plate":"ABC123"`) {
+		t.Errorf("Expected one entry and one exit of ABC123, got %d and %d", len(mqtt.entries), len(mqtt.exits))
+	}
+
+	recorder = request("GET", "/control", "")
+	state := controlState{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.GARAGES) != 1 || !state.GARAGES[0].ENTRY_PAUSED || state.GARAGES[0].OCCUPIED != 0 {
+		t.Errorf("Expected the paused, empty garage in the state, got %+v", state)
+	}
+
+	// The traffic simulator turns arrivals away at a paused entry
+	traffic := &trafficSimulator{
+		config:  TRAFFIC{ARRIVALS_PER_HOUR: 60, DWELL: DWELL{DISTRIBUTION: "lognormal", MEDIAN_MINUTES: 30}},
+		garages: []*garage{north},
+		noise:   cameras,
+		mqtt:    cameras,
+		clock:   clock,
+		start:   clock.now(),
+	}
+	for range 10 {
+		traffic.step()
+	}
+	if len(north.parkingLot) != 0 || len(mqtt.entries) != 1 {
+		t.Errorf("Expected no cars through the paused entry, got %v", north.parkingLot)
+	}
+}
+
+func TestScenarios(t *testing.T) {
+	run := func(scenario SCENARIO) ([]recordedEvent, error) {
+		events := make(chan recordedEvent, 100)
+		clock := &scenarioClock{}
+		runner, err := newScenarioRunner(scenario, &channelSink{clock: clock, events: events}, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = runner.run()
+		close(events)
+		recorded := []recordedEvent{}
+		for event := range events {
+			recorded = append(recorded, event)
+		}
+		return recorded, err
+	}
+
+	paths, err := filepath.Glob("scenarios/*.json")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("Expected example scenarios, got %v", err)
+	}
+	for _, path := range paths {
+		scenario, err := loadScenario(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := run(scenario); err != nil {
+			t.Errorf("Expected %s to pass, got %s", path, err)
+		}
+	}
+
+	scenario, err := loadScenario("scenarios/full-garage.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _ := run(scenario)
+	sequence := []string{}
+	for _, event := range events {
+		body := struct {
+			VehiclePlate string `json:"vehicle_plate"`
+		}{}
+		json.Unmarshal(event.Body, &body)
+		sequence = append(sequence, eventName(event.Queue)+" "+body.VehiclePlate+" "+event.PublishedAt[11:16])
+	}
+	expected := []string{
+		"entry FUL001 09:00", "entry FUL002 09:01",
+		// FUL003 takes the space FUL001 left at 09:30, whose exit the camera published late
+		"entry FUL003 09:30", "exit FUL001 09:32",
+		"exit FUL002 09:45", "entry FUL004 09:45", "entry FUL004 09:45",
+	}
+	if !slices.Equal(sequence, expected) {
+		t.Errorf("Expected the events\n%v\ngot\n%v", expected, sequence)
+	}
+	again, _ := run(scenario)
+	if !slices.EqualFunc(events, again, func(a, b recordedEvent) bool { return bytes.Equal(a.Body, b.Body) }) {
+		t.Errorf("Expected a scenario to produce the same events every run")
+	}
+
+	scenario.STEPS = append(scenario.STEPS, STEP{AT: "1h", ACTION: stepAssertOccupancy, OCCUPIED: 0})
+	if _, err := run(scenario); err == nil || !strings.Contains(err.Error(), "expected 0 car(s) in mall-north, got 2") {
+		t.Errorf("Expected the failed assertion, got %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"groundtruth"
+)
+
+// Faults tagged on events in the ground truth
+const (
+	faultDropped    = "dropped"
+	faultMisread    = "misread"
+	faultDuplicate  = "duplicate"
+	faultDelayed    = "delayed"
+	faultOutOfOrder = "out_of_order"
+	faultClockSkew  = "clock_skew"
+)
+
+// Failure modes of the plate cameras. Rates are probabilities between 0 and 1.
+type NOISE struct {
+	// Vehicles the entry or exit camera does not register at all
+	ENTRY_DROP_RATE float64 `json:"ENTRY_DROP_RATE"`
+	EXIT_DROP_RATE  float64 `json:"EXIT_DROP_RATE"`
+	// Plates with one character swapped for one OCR confuses it with
+	MISREAD_RATE float64 `json:"MISREAD_RATE"`
+	// Events published twice
+	DUPLICATE_RATE float64 `json:"DUPLICATE_RATE"`
+	// Events published up to MAX_DELAY_SECONDS late
+	DELAY_RATE        float64 `json:"DELAY_RATE"`
+	MAX_DELAY_SECONDS int     `json:"MAX_DELAY_SECONDS"`
+	// Exits published after the exit that follows them
+	OUT_OF_ORDER_RATE float64 `json:"OUT_OF_ORDER_RATE"`
+	// Offset of each camera's clock from the true time
+	ENTRY_CLOCK_SKEW_SECONDS float64 `json:"ENTRY_CLOCK_SKEW_SECONDS"`
+	EXIT_CLOCK_SKEW_SECONDS  float64 `json:"EXIT_CLOCK_SKEW_SECONDS"`
+	// Drop rates of single gates by "<garage>/<gate>", in place of ENTRY_ or EXIT_DROP_RATE
+	GATE_DROP_RATES map[string]float64 `json:"GATE_DROP_RATES,omitempty"`
+	// Clock skews of single lane cameras by "<garage>/<gate>/<lane>", in place of ENTRY_ or
+	// EXIT_CLOCK_SKEW_SECONDS
+	CAMERA_CLOCK_SKEW_SECONDS map[string]float64 `json:"CAMERA_CLOCK_SKEW_SECONDS,omitempty"`
+}
+
+// dropRate is the share of vehicles the cameras at a gate miss, byKind unless the gate has its own
+func (n NOISE) dropRate(at location, byKind float64) float64 {
+	if rate, ok := n.GATE_DROP_RATES[at.gateKey()]; ok {
+		return rate
+	}
+	return byKind
+}
+
+// clockSkew is the offset of the camera's clock in seconds, byKind unless the camera has its own
+func (n NOISE) clockSkew(at location, byKind float64) float64 {
+	if seconds, ok := n.CAMERA_CLOCK_SKEW_SECONDS[at.cameraKey()]; ok {
+		return seconds
+	}
+	return byKind
+}
+
+// Without a NOISE section the entry camera misses 20% of the vehicles, as it always did
+func defaultNoise() NOISE {
+	return NOISE{ENTRY_DROP_RATE: 0.2, MAX_DELAY_SECONDS: 30}
+}
+
+// Characters plate OCR is known to mix up
+var ocrConfusions = map[byte]string{
+	'0': "OD", 'O': "0DQ", 'D': "0O", 'Q': "O0",
+	'1': "I7", 'I': "1L", 'L': "I", '7': "1",
+	'2': "Z", 'Z': "2",
+	'5': "S", 'S': "5",
+	'6': "G", 'G': "6",
+	'8': "B", 'B': "8",
+}
+
+// Decides whether the entry camera at a lane registers a vehicle, one it misses gets no entry event
+type randomNoiser interface {
+	noise(at location) bool
+}
+
+// Passes events on to the broker the way real cameras would, with misread plates, skewed
+// clocks, and duplicated, delayed, reordered or missing events. The entry camera's misses are
+// decided by the toll through randomNoiser.
+type cameraNoise struct {
+	next mqttWrapper
+	// Publishes delayed events when their simulated time comes
+	clock *stepClock
+
+	mutex sync.Mutex
+	// Changed at runtime by the control API
+	config NOISE
+	// Exit held back until the next exit is published, or maxExitHold after it at the latest
+	heldExit []byte
+	// Counts the exits held back, a timer only releases the one it was set for
+	holds int
+}
+
+// How long an exit is held back when no other exit follows it
+const maxExitHold = time.Minute
+
+// settings returns the noise in effect
+func (c *cameraNoise) settings() NOISE {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.config
+}
+
+// noise decides whether the entry camera at a lane registers a vehicle, missing the gate's drop
+// rate of them
+func (c *cameraNoise) noise(at location) bool {
+	config := c.settings()
+	return random.Float64() >= config.dropRate(at, config.ENTRY_DROP_RATE)
+}
+
+func (c *cameraNoise) publishEntryEvent(body []byte) {
+	event := entryEvent{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		c.next.publishEntryEvent(body)
+		return
+	}
+	record := groundtruth.Record{
+		Event: "entry", EventId: event.Id, Plate: event.VehiclePlate, Time: event.EntryDateTime,
+		GarageId: event.GarageId, GateId: event.GateId, LaneId: event.LaneId,
+	}
+	config := c.settings()
+	faults := []string{}
+	event.VehiclePlate, faults = misread(config, event.VehiclePlate, faults)
+	at := location{garage: event.GarageId, gate: event.GateId, lane: event.LaneId}
+	event.EntryDateTime, faults = skew(event.EntryDateTime, config.clockSkew(at, config.ENTRY_CLOCK_SKEW_SECONDS), faults)
+	body, _ = json.Marshal(event)
+
+	if chance(config.DUPLICATE_RATE) {
+		faults = append(faults, faultDuplicate)
+		c.deliver(config, body, c.next.publishEntryEvent, &faults)
+	}
+	c.deliver(config, body, c.next.publishEntryEvent, &faults)
+	record.PublishedPlate = event.VehiclePlate
+	record.PublishedTime = event.EntryDateTime
+	record.Faults = faults
+	truth.record(record)
+}
+
+func (c *cameraNoise) publishExitEvent(body []byte) {
+	event := exitEvent{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		c.next.publishExitEvent(body)
+		return
+	}
+	record := groundtruth.Record{
+		Event: "exit", EventId: event.Id, Plate: event.VehiclePlate, Time: event.ExitDateTime,
+		GarageId: event.GarageId, GateId: event.GateId, LaneId: event.LaneId,
+	}
+	config := c.settings()
+	at := location{garage: event.GarageId, gate: event.GateId, lane: event.LaneId}
+	if chance(config.dropRate(at, config.EXIT_DROP_RATE)) {
+		record.Faults = []string{faultDropped}
+		truth.record(record)
+		return
+	}
+	faults := []string{}
+	event.VehiclePlate, faults = misread(config, event.VehiclePlate, faults)
+	event.ExitDateTime, faults = skew(event.ExitDateTime, config.clockSkew(at, config.EXIT_CLOCK_SKEW_SECONDS), faults)
+	body, _ = json.Marshal(event)
+	record.PublishedPlate = event.VehiclePlate
+	record.PublishedTime = event.ExitDateTime
+
+	c.mutex.Lock()
+	held := c.heldExit
+	c.heldExit = nil
+	if held == nil && chance(config.OUT_OF_ORDER_RATE) {
+		c.heldExit = body
+		c.holds++
+		hold := c.holds
+		c.mutex.Unlock()
+		record.Faults = append(faults, faultOutOfOrder)
+		truth.record(record)
+		c.clock.after(maxExitHold, func() { c.release(hold) })
+		return
+	}
+	c.mutex.Unlock()
+
+	if chance(config.DUPLICATE_RATE) {
+		faults = append(faults, faultDuplicate)
+		c.deliver(config, body, c.next.publishExitEvent, &faults)
+	}
+	c.deliver(config, body, c.next.publishExitEvent, &faults)
+	record.Faults = faults
+	truth.record(record)
+	if held != nil {
+		c.next.publishExitEvent(held)
+	}
+}
+
+// release publishes the held exit if it is still the one of hold
+func (c *cameraNoise) release(hold int) {
+	c.mutex.Lock()
+	held := c.heldExit
+	if c.holds != hold || held == nil {
+		c.mutex.Unlock()
+		return
+	}
+	c.heldExit = nil
+	c.mutex.Unlock()
+	c.next.publishExitEvent(held)
+}
+
+// flush publishes the held exit, if any, when the simulation stops
+func (c *cameraNoise) flush() {
+	c.mutex.Lock()
+	held := c.heldExit
+	c.heldExit = nil
+	c.mutex.Unlock()
+	if held != nil {
+		c.next.publishExitEvent(held)
+	}
+}
+
+// deliver publishes body now or, for a delayed event, later
+func (c *cameraNoise) deliver(config NOISE, body []byte, publish func([]byte), faults *[]string) {
+	if config.MAX_DELAY_SECONDS <= 0 || !chance(config.DELAY_RATE) {
+		publish(body)
+		return
+	}
+	if !slices.Contains(*faults, faultDelayed) {
+		*faults = append(*faults, faultDelayed)
+	}
+	delay := time.Duration(random.Int63n(int64(config.MAX_DELAY_SECONDS)*int64(time.Second)) + 1)
+	c.clock.after(delay, func() { publish(body) })
+}
+
+// misread swaps one character of the plate for one OCR confuses it with
+func misread(config NOISE, plate string, faults []string) (string, []string) {
+	if !chance(config.MISREAD_RATE) {
+		return plate, faults
+	}
+	positions := []int{}
+	for i := 0; i < len(plate); i++ {
+		if _, ok := ocrConfusions[plate[i]]; ok {
+			positions = append(positions, i)
+		}
+	}
+	if len(positions) == 0 {
+		return plate, faults
+	}
+	i := positions[random.Intn(len(positions))]
+	confusions := ocrConfusions[plate[i]]
+	misread := []byte(plate)
+	misread[i] = confusions[random.Intn(len(confusions))]
+	return string(misread), append(faults, faultMisread)
+}
+
+// skew shifts an event timestamp by the camera's clock offset
+func skew(timestamp string, seconds float64, faults []string) (string, []string) {
+	if seconds == 0 {
+		return timestamp, faults
+	}
+	parsed, err := time.Parse(eventTimeLayout, timestamp)
+	if err != nil {
+		return timestamp, faults
+	}
+	skewed := parsed.Add(time.Duration(seconds * float64(time.Second)))
+	return skewed.UTC().Format(eventTimeLayout), append(faults, faultClockSkew)
+}
+
+func chance(rate float64) bool {
+	return rate > 0 && random.Float64() < rate
+}
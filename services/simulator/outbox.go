@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errOutboxFull = errors.New("outbox full")
+
+// Event waiting for the broker to confirm it. On disk a confirmed event is recorded as its id
+// with Confirmed set.
+type outboxEntry struct {
+	Id        string          `json:"id"`
+	Queue     string          `json:"queue,omitempty"`
+	Body      json.RawMessage `json:"body,omitempty"`
+	Headers   amqp.Table      `json:"headers,omitempty"`
+	Confirmed bool            `json:"confirmed,omitempty"`
+
+	// Delivery tag on the current channel, zero until published on it
+	tag uint64
+	// A nacked event is published again once this has passed
+	retryAt time.Time
+	// Publish span, ended once the event is confirmed. Events loaded from disk have none.
+	span trace.Span
+}
+
+// Events published but not confirmed yet, oldest first. With a path the outbox is also kept on
+// disk, so its events survive a restart of the simulator. The file is a log: every event and
+// every confirmation is appended and synced, and the log is compacted to the events left once
+// most of it is confirmed.
+type outbox struct {
+	capacity int
+	path     string
+
+	mutex   sync.Mutex
+	entries []*outboxEntry
+	// Open for appending, nil without a path
+	file *os.File
+	// Lines in the log
+	records int
+}
+
+// The log is compacted once it has this many lines more than twice the events left
+const outboxCompactSlack = 1000
+
+// loadOutbox reads the events left in path by a previous run, if any
+func loadOutbox(path string, capacity int) (*outbox, error) {
+	o := &outbox{capacity: capacity, path: path}
+	if path == "" {
+		return o, nil
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, o.compact()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	var torn error
+	for scanner.Scan() {
+		if torn != nil {
+			return nil, fmt.Errorf("failed to read outbox: %w", torn)
+		}
+		record := &outboxEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			// Only the last line can be cut short, by a crash while it was appended
+			torn = err
+			continue
+		}
+		if record.Confirmed {
+			o.entries = slices.DeleteFunc(o.entries, func(entry *outboxEntry) bool { return entry.Id == record.Id })
+			continue
+		}
+		o.entries = append(o.entries, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read outbox: %w", err)
+	}
+	if torn != nil {
+		log.Printf("Ignoring the incomplete last line of the outbox: %s", torn)
+	}
+	outboxSize.Set(float64(len(o.entries)))
+	return o, o.compact()
+}
+
+func (o *outbox) add(entry *outboxEntry) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.capacity > 0 && len(o.entries) >= o.capacity {
+		return errOutboxFull
+	}
+	o.entries = append(o.entries, entry)
+	outboxSize.Set(float64(len(o.entries)))
+	// The event is still published when it cannot be saved, it is only lost on a restart
+	if err := o.append(entry); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+// unpublished returns the events to publish on the current channel, in order
+func (o *outbox) unpublished(now time.Time) []*outboxEntry {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	entries := []*outboxEntry{}
+	for _, entry := range o.entries {
+		if entry.tag == 0 && !now.Before(entry.retryAt) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (o *outbox) published(entry *outboxEntry, tag uint64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	entry.tag = tag
+}
+
+// reset forgets the delivery tags of a channel that was closed, nothing published on it is
+// confirmed any more
+func (o *outbox) reset() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, entry := range o.entries {
+		entry.tag = 0
+	}
+}
+
+// settle removes an acked event, a nacked one is published again after retryDelay. It returns
+// the event the confirmation is for.
+func (o *outbox) settle(confirmation amqp.Confirmation, retryDelay time.Duration) *outboxEntry {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for i, entry := range o.entries {
+		if entry.tag != confirmation.DeliveryTag {
+			continue
+		}
+		if !confirmation.Ack {
+			entry.tag = 0
+			entry.retryAt = time.Now().Add(retryDelay)
+			return entry
+		}
+		o.entries = append(o.entries[:i], o.entries[i+1:]...)
+		outboxSize.Set(float64(len(o.entries)))
+		if err := o.append(&outboxEntry{Id: entry.Id, Confirmed: true}); err != nil {
+			log.Println(err)
+		}
+		return entry
+	}
+	return nil
+}
+
+func (o *outbox) len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return len(o.entries)
+}
+
+// append adds a record to the log and syncs it, the caller holds the mutex. A confirmation that
+// leaves the log mostly confirmed compacts it.
+func (o *outbox) append(record *outboxEntry) error {
+	if o.path == "" {
+		return nil
+	}
+	if o.file == nil {
+		// The last compaction failed and left no log open, a new one records the events left
+		return o.compact()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to save outbox: %w", err)
+	}
+	if _, err := o.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to save outbox: %w", err)
+	}
+	if err := o.file.Sync(); err != nil {
+		return fmt.Errorf("failed to save outbox: %w", err)
+	}
+	o.records++
+	if record.Confirmed && o.records > 2*len(o.entries)+outboxCompactSlack {
+		return o.compact()
+	}
+	return nil
+}
+
+// compact rewrites the log with the events left and reopens it for appending, the caller holds
+// the mutex. The new log is synced before it replaces the old one by rename, so a crash leaves
+// one of them whole.
+func (o *outbox) compact() error {
+	if o.path == "" {
+		return nil
+	}
+	if o.file != nil {
+		o.file.Close()
+		o.file = nil
+	}
+	temp := o.path + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return fmt.Errorf("failed to compact outbox: %w", err)
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range o.entries {
+		if err := encoder.Encode(entry); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to compact outbox: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to compact outbox: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to compact outbox: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to compact outbox: %w", err)
+	}
+	if err := os.Rename(temp, o.path); err != nil {
+		return fmt.Errorf("failed to compact outbox: %w", err)
+	}
+	// The rename is only durable once the directory is synced
+	if dir, err := os.Open(filepath.Dir(o.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	o.file, err = os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open outbox: %w", err)
+	}
+	o.records = len(o.entries)
+	return nil
+}
@@ -1,76 +1,354 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+const (
+	// Must match the backend's declaration, which dead-letters failed messages
+	deadLetterExchange = "parking-dlx"
+
+	entryQueueName = "entry-event"
+	exitQueueName  = "exit-event"
+)
+
+var (
+	eventsPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "events_published_total",
+		Help: "Events published to RabbitMQ, including republished ones, or written to an offline sink",
+	}, []string{"event"})
+	eventsConfirmed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "events_confirmed_total",
+		Help: "Events the broker confirmed",
+	}, []string{"event"})
+	eventsNacked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "events_nacked_total",
+		Help: "Events the broker nacked, they are published again",
+	}, []string{"event"})
+	eventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "events_dropped_total",
+		Help: "Events dropped because the outbox was full or the sink failed to write them",
+	}, []string{"event"})
+	outboxSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "outbox_events",
+		Help: "Events buffered in the outbox until the broker confirms them",
+	})
+	brokerBlocked = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "broker_blocked",
+		Help: "1 while the broker blocks publishing for flow control",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(eventsPublished)
+	prometheus.MustRegister(eventsConfirmed)
+	prometheus.MustRegister(eventsNacked)
+	prometheus.MustRegister(eventsDropped)
+	prometheus.MustRegister(outboxSize)
+	prometheus.MustRegister(brokerBlocked)
+}
+
+// Publishes events with publisher confirms. Events wait in the outbox until the broker confirms
+// them and are published again after a reconnect, so a broker restart loses nothing as long as
+// the outbox has room.
 type rabbitmqWrapper struct {
-	conn   *amqp.Connection
-	ch     *amqp.Channel
-	entryQ amqp.Queue
-	exitQ  amqp.Queue
+	url    string
+	outbox *outbox
+	// Reconnect delay, doubled up to maxBackoff while the broker stays unreachable
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// Liveness fails once the broker has been unreachable for this long, zero disables it
+	maxDowntime time.Duration
+	// Signalled when an event is added to the outbox
+	wake chan struct{}
+
+	mutex     sync.RWMutex
+	connected bool
+	blocked   bool
+	// When the broker was last reachable, or when the wrapper started
+	downSince time.Time
+}
+
+func newRabbitClient(url string, outbox *outbox) *rabbitmqWrapper {
+	return &rabbitmqWrapper{
+		url:         url,
+		outbox:      outbox,
+		backoff:     time.Second,
+		maxBackoff:  30 * time.Second,
+		maxDowntime: 15 * time.Minute,
+		wake:        make(chan struct{}, 1),
+		downSince:   time.Now(),
+	}
+}
+
+// rabbitmqURLFromEnv builds the broker URL from RABBITMQ_HOST and RABBITMQ_PORT
+func rabbitmqURLFromEnv() (string, error) {
+	rabbitmqHost := os.Getenv("RABBITMQ_HOST")
+	rabbitmqPort := os.Getenv("RABBITMQ_PORT")
+	if rabbitmqHost == "" || rabbitmqPort == "" {
+		return "", errors.New("RABBITMQ_HOST and RABBITMQ_PORT must be set")
+	}
+	return fmt.Sprintf("amqp://guest:guest@%s:%s/", rabbitmqHost, rabbitmqPort), nil
+}
+
+func declareQueues(ch *amqp.Channel) error {
+	queueArgs := amqp.Table{"x-dead-letter-exchange": deadLetterExchange}
+	for _, name := range []string{entryQueueName, exitQueueName} {
+		_, err := ch.QueueDeclare(
+			name,      // name
+			true,      // durable
+			false,     // delete when unused
+			false,     // exclusive
+			false,     // no-wait
+			queueArgs, // arguments
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare queue %s: %w", name, err)
+		}
+	}
+	return nil
 }
 
-func createRabbitClient(url string) (rabbitmqWrapper, error) {
-	rabbitmq := rabbitmqWrapper{}
-	var err error
-	rabbitmq.conn, err = amqp.Dial(url)
+// run keeps a connection open and publishes the outbox on it. It does not return.
+func (r *rabbitmqWrapper) run() {
+	delay := r.backoff
+	for {
+		start := time.Now()
+		err := r.session()
+		log.Printf("Lost RabbitMQ connection, reconnecting in %s: %s", delay, err)
+		// A session that lasted a while means the broker was back, start over with the backoff
+		if time.Since(start) > r.maxBackoff {
+			delay = r.backoff
+		}
+		time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)))
+		delay = min(delay*2, r.maxBackoff)
+	}
+}
+
+// session connects, publishes everything in the outbox and then new events as they come, until
+// the connection or the channel closes
+func (r *rabbitmqWrapper) session() error {
+	conn, err := amqp.Dial(r.url)
 	if err != nil {
-		return rabbitmq, err
+		return err
 	}
+	defer conn.Close()
 
-	rabbitmq.ch, err = rabbitmq.conn.Channel()
+	ch, err := conn.Channel()
 	if err != nil {
-		rabbitmq.conn.Close()
-		return rabbitmq, err
-	}
-
-	rabbitmq.entryQ, err = rabbitmq.ch.QueueDeclare(
-		"entry-event", // name
-		false,         // durable
-		false,         // delete when unused
-		false,         // exclusive
-		false,         // no-wait
-		nil,           // arguments
-	)
+		return fmt.Errorf("failed to open a channel: %w", err)
+	}
+	err = declareQueues(ch)
 	if err != nil {
-		rabbitmq.conn.Close()
-		rabbitmq.ch.Close()
-		return rabbitmq, err
-	}
-
-	rabbitmq.exitQ, err = rabbitmq.ch.QueueDeclare(
-		"exit-event", // name
-		false,        // durable
-		false,        // delete when unused
-		false,        // exclusive
-		false,        // no-wait
-		nil,          // arguments
-	)
+		return err
+	}
+	err = ch.Confirm(false)
 	if err != nil {
-		rabbitmq.conn.Close()
-		rabbitmq.ch.Close()
-		return rabbitmq, err
+		return fmt.Errorf("failed to enable publisher confirms: %w", err)
 	}
+	// Confirmations are settled on a goroutine of their own. The library stops delivering on the
+	// channel while a confirmation waits to be received, so publishing must never wait for them.
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 100))
+	settled := make(chan struct{})
+	go func() {
+		defer close(settled)
+		for confirmation := range confirms {
+			r.settle(confirmation)
+		}
+	}()
+	// Delivery tags start over on the next channel, so every confirmation of this one is settled
+	// before the outbox is replayed. Closing the connection closes confirms.
+	defer func() {
+		conn.Close()
+		<-settled
+	}()
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	blocked := conn.NotifyBlocked(make(chan amqp.Blocking, 1))
 
-	return rabbitmq, nil
-}
+	// Nothing published on the previous channel will be confirmed, replay it all in order
+	r.outbox.reset()
+	r.setConnected(true)
+	defer r.setConnected(false)
+	log.Printf("Connected to RabbitMQ, replaying %d buffered event(s)", r.outbox.len())
 
-func newRabbitClient(url string) (rabbitmqWrapper, error) {
-	var rabbitmq rabbitmqWrapper
-	var err error
-	for i := 0; ; i++ {
-		rabbitmq, err = createRabbitClient(url)
-		if err == nil {
-			break
+	retry := time.NewTicker(time.Second)
+	defer retry.Stop()
+	for {
+		if !r.isBlocked() {
+			err = r.publishPending(ch)
+			if err != nil {
+				return err
+			}
 		}
-		time.Sleep(1 * time.Second)
 
-		if i == 15*60 {
-			return rabbitmq, err
+		select {
+		case <-r.wake:
+		case <-retry.C:
+		case blocking := <-blocked:
+			r.setBlocked(blocking)
+		case reason := <-connClosed:
+			return closeReason(reason)
+		case reason := <-chClosed:
+			return closeReason(reason)
 		}
 	}
-	return rabbitmq, nil
+}
+
+// The notification channels are closed without a reason on a clean shutdown
+func closeReason(reason *amqp.Error) error {
+	if reason == nil {
+		return errors.New("connection closed")
+	}
+	return reason
+}
+
+func (r *rabbitmqWrapper) publishPending(ch *amqp.Channel) error {
+	for _, entry := range r.outbox.unpublished(time.Now()) {
+		tag := ch.GetNextPublishSeqNo()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := ch.PublishWithContext(ctx,
+			"",          // exchange
+			entry.Queue, // routing key
+			false,       // mandatory
+			false,       // immediate
+			amqp.Publishing{
+				Headers:      entry.Headers,
+				ContentType:  "text/plain",
+				DeliveryMode: amqp.Persistent,
+				MessageId:    entry.Id,
+				Body:         entry.Body,
+			})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to publish %s: %w", entry.Queue, err)
+		}
+		r.outbox.published(entry, tag)
+		eventsPublished.WithLabelValues(eventName(entry.Queue)).Inc()
+	}
+	return nil
+}
+
+func (r *rabbitmqWrapper) settle(confirmation amqp.Confirmation) {
+	entry := r.outbox.settle(confirmation, time.Second)
+	if entry == nil {
+		return
+	}
+	if !confirmation.Ack {
+		log.Printf("Broker nacked %s %s, publishing it again", entry.Queue, entry.Id)
+		eventsNacked.WithLabelValues(eventName(entry.Queue)).Inc()
+		return
+	}
+	eventsConfirmed.WithLabelValues(eventName(entry.Queue)).Inc()
+	if entry.span != nil {
+		endSpan(entry.span, nil)
+	}
+}
+
+func (r *rabbitmqWrapper) setConnected(connected bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.connected = connected
+	r.blocked = false
+	brokerBlocked.Set(0)
+	if !connected {
+		r.downSince = time.Now()
+	}
+}
+
+func (r *rabbitmqWrapper) setBlocked(blocking amqp.Blocking) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.blocked = blocking.Active
+	if blocking.Active {
+		log.Printf("Broker blocked publishing: %s", blocking.Reason)
+		brokerBlocked.Set(1)
+	} else {
+		log.Println("Broker unblocked publishing")
+		brokerBlocked.Set(0)
+	}
+}
+
+func (r *rabbitmqWrapper) isBlocked() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.blocked
+}
+
+// ready fails while the broker is unreachable, events are only buffered then
+func (r *rabbitmqWrapper) ready(ctx context.Context) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if !r.connected {
+		return fmt.Errorf("not connected since %s", r.downSince.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// flowControl fails while the broker blocks publishing
+func (r *rabbitmqWrapper) flowControl(ctx context.Context) error {
+	if r.isBlocked() {
+		return errors.New("broker blocked publishing")
+	}
+	return nil
+}
+
+// live fails once the broker has been unreachable for longer than maxDowntime
+func (r *rabbitmqWrapper) live() error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if !r.connected && r.maxDowntime > 0 && time.Since(r.downSince) > r.maxDowntime {
+		return fmt.Errorf("RabbitMQ unreachable since %s", r.downSince.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (r *rabbitmqWrapper) publishEntryEvent(body []byte) {
+	r.publish(entryQueueName, body)
+}
+
+func (r *rabbitmqWrapper) publishExitEvent(body []byte) {
+	r.publish(exitQueueName, body)
+}
+
+// publish adds the event to the outbox, the publishing goroutine takes it from there
+func (r *rabbitmqWrapper) publish(queue string, body []byte) {
+	if err := r.enqueue(queue, body); err != nil {
+		log.Printf("Failed to publish %s: %s", queue, err)
+		eventsDropped.WithLabelValues(eventName(queue)).Inc()
+	}
+}
+
+// enqueue adds the event to the outbox and wakes the publishing goroutine, it fails with
+// errOutboxFull while the outbox has no room
+func (r *rabbitmqWrapper) enqueue(queue string, body []byte) error {
+	span, headers := startPublishSpan(queue)
+	entry := &outboxEntry{Id: uuid.New().String(), Queue: queue, Body: body, Headers: headers, span: span}
+	if err := r.outbox.add(entry); err != nil {
+		endSpan(span, err)
+		return err
+	}
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// eventName is the metrics label of a queue's events, entry or exit
+func eventName(queue string) string {
+	return strings.TrimSuffix(queue, "-event")
 }
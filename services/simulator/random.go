@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Source of every random decision of the simulation, so that a seed reproduces a run. The tolls of
+// the default traffic draw from sources seeded from it. Publishing retries keep using the global
+// source, they do not change the events.
+var random = rand.New(&lockedSource{source: rand.NewSource(time.Now().UnixNano()).(rand.Source64)})
+
+// Lets the simulation loop and the control API share one source
+type lockedSource struct {
+	mutex  sync.Mutex
+	source rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.source.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.source.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.source.Seed(seed)
+}
+
+// seedRandom restarts the simulation's random sequence. A zero seed picks one from the time.
+// It returns the seed used.
+func seedRandom(seed int64) int64 {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	random.Seed(seed)
+	return seed
+}
+
+// newEventId returns a version 4 UUID drawn from the seeded source
+func newEventId() string {
+	id, err := uuid.NewRandomFromReader(random)
+	if err != nil {
+		// Reading from math/rand never fails
+		panic(err)
+	}
+	return id.String()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// runReplay publishes events recorded by the file sink to RabbitMQ: simulator replay [-speed N]
+// <file>. The events keep their ids and timestamps, only the pace between them changes.
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	speed := flags.Float64("speed", 1, "multiple of the recorded pace, 0 publishes as fast as possible")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 || *speed < 0 {
+		fmt.Println("usage: simulator replay [-speed N] <file>")
+		return 2
+	}
+
+	url, err := rabbitmqURLFromEnv()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer file.Close()
+
+	outbox, err := loadOutbox("", getEnvInt("OUTBOX_CAPACITY", 1000))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	rabbitmq := newRabbitClient(url, outbox)
+	go rabbitmq.run()
+
+	count, err := replay(file, *speed, time.Sleep, func(event recordedEvent) {
+		// Wait for room instead of dropping, a replay has to publish every event
+		for errors.Is(rabbitmq.enqueue(event.Queue, event.Body), errOutboxFull) {
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	for outbox.len() > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Printf("Replayed %d event(s) from %s", count, flags.Arg(0))
+	return 0
+}
+
+// replay hands every recorded event to publish, sleeping the recorded time between events
+// divided by speed. Speed zero does not sleep at all.
+func replay(in io.Reader, speed float64, sleep func(time.Duration), publish func(recordedEvent)) (int, error) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 1024*1024)
+	count, line := 0, 0
+	var previous time.Time
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		event := recordedEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return count, fmt.Errorf("line %d: %w", line, err)
+		}
+		if event.Queue != entryQueueName && event.Queue != exitQueueName {
+			return count, fmt.Errorf("line %d: unknown queue %q", line, event.Queue)
+		}
+		publishedAt, err := time.Parse(eventTimeLayout, event.PublishedAt)
+		if err != nil {
+			return count, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if speed > 0 && !previous.IsZero() && publishedAt.After(previous) {
+			sleep(time.Duration(float64(publishedAt.Sub(previous)) / speed))
+		}
+		previous = publishedAt
+		publish(event)
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	return count, nil
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Scenario steps
+const (
+	stepEnter           = "enter"
+	stepExit            = "exit"
+	stepMisread         = "misread"
+	stepDuplicate       = "duplicate"
+	stepDelay           = "delay"
+	stepDrop            = "drop"
+	stepAssertOccupancy = "assert-occupancy"
+)
+
+// Scripted run of the tolls, written as JSON. Garages are set up as in config.json, without
+// GARAGES there is a single garage default of GARAGE_CAPACITY.
+type SCENARIO struct {
+	// Time of the first step, steps are offsets from it
+	START_TIME      string   `json:"START_TIME"`
+	GARAGE_CAPACITY int      `json:"GARAGE_CAPACITY"`
+	GARAGES         []GARAGE `json:"GARAGES"`
+	// Seed of the event ids, 1 when not set, so that a scenario always produces the same events
+	SEED  int64  `json:"SEED"`
+	STEPS []STEP `json:"STEPS"`
+}
+
+// One car through one toll, or an assertion. Faults name the TOLL they happen at:
+//   - enter, exit: PLATE enters or leaves, and the camera publishes it
+//   - misread: the camera publishes the plate AS
+//   - duplicate: the camera publishes the event twice
+//   - delay: the camera publishes the event DELAY later
+//   - drop: the camera publishes nothing
+//   - assert-occupancy: the garage holds OCCUPIED cars, and QUEUED wait at its entry if set
+//
+// A car entering a full garage queues at the entry and goes in as soon as a car leaves.
+type STEP struct {
+	// Offset from START_TIME as a Go duration, such as 1h30m. Steps are in order.
+	AT     string `json:"AT"`
+	ACTION string `json:"ACTION"`
+	// May be left out when there is a single garage
+	GARAGE string `json:"GARAGE"`
+	// entry or exit, for the faults
+	TOLL  string `json:"TOLL"`
+	PLATE string `json:"PLATE"`
+	// First gate of the toll and lane 1 when not set
+	GATE     string `json:"GATE"`
+	LANE     string `json:"LANE"`
+	AS       string `json:"AS"`
+	DELAY    string `json:"DELAY"`
+	OCCUPIED int    `json:"OCCUPIED"`
+	QUEUED   *int   `json:"QUEUED"`
+}
+
+// Clock of a scenario, which jumps from step to step
+type scenarioClock struct {
+	current time.Time
+}
+
+func (c *scenarioClock) now() time.Time {
+	return c.current
+}
+
+func (c *scenarioClock) sleep(d time.Duration) {
+	c.current = c.current.Add(d)
+}
+
+// Event the camera publishes later
+type pendingEvent struct {
+	at      time.Time
+	publish func([]byte)
+	body    []byte
+}
+
+// A garage as a scenario sees it
+type scenarioGarage struct {
+	*garage
+	// Cars waiting at the entry of the full garage, with the step that brought them
+	queue []STEP
+}
+
+// Runs the steps of a scenario in simulated time. Events go to mqtt as the cameras publish them,
+// the clock is at their publishing time.
+type scenarioRunner struct {
+	scenario SCENARIO
+	mqtt     mqttWrapper
+	clock    *scenarioClock
+
+	garages map[string]*scenarioGarage
+	pending []pendingEvent
+}
+
+// runScenarioCommand runs a scenario file and writes its events as NDJSON, the format of the file
+// sink that replay reads: simulator scenario [-out path] <scenario>
+func runScenarioCommand(args []string) int {
+	flags := flag.NewFlagSet("scenario", flag.ContinueOnError)
+	outPath := flags.String("out", "", "file to write the events to instead of stdout")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		fmt.Println("usage: simulator scenario [-out path] <scenario>")
+		return 2
+	}
+
+	scenario, err := loadScenario(flags.Arg(0))
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	clock := &scenarioClock{}
+	runner, err := newScenarioRunner(scenario, &ndjsonSink{clock: clock, out: out}, clock)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := runner.run(); err != nil {
+		log.Printf("Scenario %s failed: %s", flags.Arg(0), err)
+		return 1
+	}
+	return 0
+}
+
+func loadScenario(path string) (SCENARIO, error) {
+	scenario := SCENARIO{}
+	file, err := os.Open(path)
+	if err != nil {
+		return scenario, fmt.Errorf("failed to open scenario: %w", err)
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&scenario); err != nil {
+		return scenario, fmt.Errorf("failed to decode scenario: %w", err)
+	}
+	return scenario, nil
+}
+
+func newScenarioRunner(scenario SCENARIO, mqtt mqttWrapper, clock *scenarioClock) (*scenarioRunner, error) {
+	start, err := time.Parse(time.RFC3339, scenario.START_TIME)
+	if err != nil {
+		return nil, fmt.Errorf("START_TIME must be an RFC 3339 time: %w", err)
+	}
+	clock.current = start
+	config := CONFIG{GARAGE_CAPACITY: scenario.GARAGE_CAPACITY, GARAGES: scenario.GARAGES}
+	if err := validateGarages(config.garages()); err != nil {
+		return nil, fmt.Errorf("invalid garages: %w", err)
+	}
+
+	runner := &scenarioRunner{scenario: scenario, mqtt: mqtt, clock: clock, garages: map[string]*scenarioGarage{}}
+	for _, garage := range newGarages(config) {
+		runner.garages[garage.config.ID] = &scenarioGarage{garage: garage}
+	}
+	return runner, nil
+}
+
+// run executes every step, publishing delayed events in between, and stops at the first step
+// that fails
+func (r *scenarioRunner) run() error {
+	seed := r.scenario.SEED
+	if seed == 0 {
+		seed = 1
+	}
+	seedRandom(seed)
+
+	start := r.clock.now()
+	previous := time.Duration(0)
+	for i, step := range r.scenario.STEPS {
+		at, err := time.ParseDuration(step.AT)
+		if err != nil || at < previous {
+			return fmt.Errorf("step %d: AT must be a duration no earlier than the step before", i+1)
+		}
+		previous = at
+		r.publishPending(start.Add(at))
+		r.clock.current = start.Add(at)
+		if err := r.step(step); err != nil {
+			return fmt.Errorf("step %d (%s at %s): %w", i+1, step.ACTION, step.AT, err)
+		}
+	}
+	r.publishPending(time.Time{})
+	return nil
+}
+
+func (r *scenarioRunner) step(step STEP) error {
+	garage, err := r.garage(step.GARAGE)
+	if err != nil {
+		return err
+	}
+
+	switch step.ACTION {
+	case stepEnter:
+		return r.enter(garage, step)
+	case stepExit:
+		return r.exit(garage, step)
+	case stepMisread, stepDuplicate, stepDelay, stepDrop:
+		switch step.TOLL {
+		case "entry":
+			return r.enter(garage, step)
+		case "exit":
+			return r.exit(garage, step)
+		default:
+			return errors.New("TOLL must be entry or exit")
+		}
+	case stepAssertOccupancy:
+		if len(garage.parkingLot) != step.OCCUPIED {
+			return fmt.Errorf("expected %d car(s) in %s, got %d", step.OCCUPIED, garage.config.ID, len(garage.parkingLot))
+		}
+		if step.QUEUED != nil && len(garage.queue) != *step.QUEUED {
+			return fmt.Errorf("expected %d car(s) queued at %s, got %d", *step.QUEUED, garage.config.ID, len(garage.queue))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown ACTION %q", step.ACTION)
+	}
+}
+
+// garage finds the garage of a step, which may leave it out when there is only one
+func (r *scenarioRunner) garage(id string) (*scenarioGarage, error) {
+	if id == "" && len(r.garages) == 1 {
+		for _, garage := range r.garages {
+			return garage, nil
+		}
+	}
+	garage, ok := r.garages[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown garage %q", id)
+	}
+	return garage, nil
+}
+
+func (r *scenarioRunner) enter(garage *scenarioGarage, step STEP) error {
+	if step.PLATE == "" {
+		return errors.New("PLATE must be set")
+	}
+	if slices.Contains(garage.parkingLot, step.PLATE) || slices.ContainsFunc(garage.queue, func(queued STEP) bool {
+		return queued.PLATE == step.PLATE
+	}) {
+		return fmt.Errorf("%s is already at %s", step.PLATE, garage.config.ID)
+	}
+	if garage.full() {
+		garage.queue = append(garage.queue, step)
+		return nil
+	}
+	return r.letIn(garage, step)
+}
+
+func (r *scenarioRunner) letIn(garage *scenarioGarage, step STEP) error {
+	at, err := r.location(garage, garage.config.ENTRY_GATES, step)
+	if err != nil {
+		return err
+	}
+	published, err := publishedPlate(step)
+	if err != nil {
+		return err
+	}
+	garage.parkingLot = append(garage.parkingLot, step.PLATE)
+	event := entryEvent{
+		Id:            newEventId(),
+		VehiclePlate:  published,
+		EntryDateTime: r.clock.now().UTC().Format(eventTimeLayout),
+		GarageId:      at.garage,
+		GateId:        at.gate,
+		LaneId:        at.lane,
+	}
+	return r.camera(step, event, r.mqtt.publishEntryEvent)
+}
+
+func (r *scenarioRunner) exit(garage *scenarioGarage, step STEP) error {
+	carIndex := slices.Index(garage.parkingLot, step.PLATE)
+	if carIndex < 0 {
+		return fmt.Errorf("%s is not inside %s", step.PLATE, garage.config.ID)
+	}
+	at, err := r.location(garage, garage.config.EXIT_GATES, step)
+	if err != nil {
+		return err
+	}
+	published, err := publishedPlate(step)
+	if err != nil {
+		return err
+	}
+	garage.parkingLot = slices.Delete(garage.parkingLot, carIndex, carIndex+1)
+	event := exitEvent{
+		Id:           newEventId(),
+		VehiclePlate: published,
+		ExitDateTime: r.clock.now().UTC().Format(eventTimeLayout),
+		GarageId:     at.garage,
+		GateId:       at.gate,
+		LaneId:       at.lane,
+	}
+	if err := r.camera(step, event, r.mqtt.publishExitEvent); err != nil {
+		return err
+	}
+
+	// The first queued car takes the free space
+	if len(garage.queue) > 0 {
+		next := garage.queue[0]
+		garage.queue = garage.queue[1:]
+		return r.letIn(garage, next)
+	}
+	return nil
+}
+
+// location returns the gate and lane of a step, the first gate and lane 1 by default
+func (r *scenarioRunner) location(garage *scenarioGarage, gates []GATE, step STEP) (location, error) {
+	at := location{garage: garage.config.ID, gate: gates[0].ID, lane: "1"}
+	if step.GATE != "" {
+		if !slices.ContainsFunc(gates, func(gate GATE) bool { return gate.ID == step.GATE }) {
+			return at, fmt.Errorf("unknown gate %q", step.GATE)
+		}
+		at.gate = step.GATE
+	}
+	if step.LANE != "" {
+		at.lane = step.LANE
+	}
+	return at, nil
+}
+
+// publishedPlate returns the plate the camera reads, AS for a misread
+func publishedPlate(step STEP) (string, error) {
+	if step.ACTION != stepMisread {
+		return step.PLATE, nil
+	}
+	if step.AS == "" {
+		return "", errors.New("AS must be set")
+	}
+	return step.AS, nil
+}
+
+// camera publishes the event the way the step's fault says
+func (r *scenarioRunner) camera(step STEP, event any, publish func([]byte)) error {
+	if step.ACTION == stepDrop {
+		return nil
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	switch step.ACTION {
+	case stepDuplicate:
+		publish(body)
+		publish(body)
+	case stepDelay:
+		delay, err := time.ParseDuration(step.DELAY)
+		if err != nil || delay < 0 {
+			return errors.New("DELAY must be a non-negative duration")
+		}
+		r.pending = append(r.pending, pendingEvent{at: r.clock.now().Add(delay), publish: publish, body: body})
+		// Events due at the same time keep the order they were delayed in
+		sort.SliceStable(r.pending, func(i, j int) bool { return r.pending[i].at.Before(r.pending[j].at) })
+	default:
+		publish(body)
+	}
+	return nil
+}
+
+// publishPending publishes the delayed events due before until, or all of them for a zero until
+func (r *scenarioRunner) publishPending(until time.Time) {
+	for len(r.pending) > 0 && (until.IsZero() || r.pending[0].at.Before(until)) {
+		event := r.pending[0]
+		r.pending = r.pending[1:]
+		r.clock.current = event.at
+		event.publish(event.body)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// Event as the offline sinks record it and replay reads it back. PublishedAt is the simulated
+// time the event was handed to the sink, which replay paces by.
+type recordedEvent struct {
+	Queue       string          `json:"queue"`
+	PublishedAt string          `json:"published_at"`
+	Body        json.RawMessage `json:"body"`
+}
+
+func record(queue string, body []byte, clock clocker) recordedEvent {
+	return recordedEvent{Queue: queue, PublishedAt: clock.now().UTC().Format(eventTimeLayout), Body: body}
+}
+
+// Writes events as NDJSON, to a file or to stdout, instead of publishing them
+type ndjsonSink struct {
+	clock clocker
+
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func newFileSink(path string, clock clocker) (*ndjsonSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return &ndjsonSink{clock: clock, out: file}, nil
+}
+
+func (s *ndjsonSink) publishEntryEvent(body []byte) {
+	s.write(entryQueueName, body)
+}
+
+func (s *ndjsonSink) publishExitEvent(body []byte) {
+	s.write(exitQueueName, body)
+}
+
+func (s *ndjsonSink) write(queue string, body []byte) {
+	line, err := json.Marshal(record(queue, body, s.clock))
+	if err != nil {
+		log.Printf("Failed to marshal %s: %s", queue, err)
+		eventsDropped.WithLabelValues(eventName(queue)).Inc()
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.out.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write %s: %s", queue, err)
+		eventsDropped.WithLabelValues(eventName(queue)).Inc()
+		return
+	}
+	eventsPublished.WithLabelValues(eventName(queue)).Inc()
+}
+
+// Hands events to a consumer in the same process, publishing blocks while the channel is full
+type channelSink struct {
+	clock  clocker
+	events chan<- recordedEvent
+}
+
+func (s *channelSink) publishEntryEvent(body []byte) {
+	s.events <- record(entryQueueName, body, s.clock)
+}
+
+func (s *channelSink) publishExitEvent(body []byte) {
+	s.events <- record(exitQueueName, body, s.clock)
+}
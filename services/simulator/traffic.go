@@ -0,0 +1,272 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"time"
+)
+
+// Arrival and dwell time profiles. Without ARRIVALS_PER_HOUR the tolls fall back to the uniform
+// MAX_ENTRY_WAIT and MAX_EXIT_WAIT waits.
+type TRAFFIC struct {
+	// Mean arrival rate, scaled by the profiles below
+	ARRIVALS_PER_HOUR float64 `json:"ARRIVALS_PER_HOUR"`
+	// 24 multipliers of the arrival rate, one per hour of the day, interpolated in between
+	HOURLY_PROFILE []float64 `json:"HOURLY_PROFILE"`
+	// 7 multipliers of the arrival rate, Monday first
+	WEEKLY_PROFILE []float64 `json:"WEEKLY_PROFILE"`
+	DWELL          DWELL     `json:"DWELL"`
+}
+
+// Distribution of how long cars stay
+type DWELL struct {
+	// lognormal or histogram
+	DISTRIBUTION string `json:"DISTRIBUTION"`
+	// Parameters of the lognormal distribution
+	MEDIAN_MINUTES float64 `json:"MEDIAN_MINUTES"`
+	SIGMA          float64 `json:"SIGMA"`
+	// Empirical distribution, a stay falls in a bucket with its weight and is uniform within it
+	HISTOGRAM []DWELL_BUCKET `json:"HISTOGRAM"`
+	// Longest stay, zero for no limit
+	MAX_MINUTES float64 `json:"MAX_MINUTES"`
+}
+
+// Stays between the previous bucket's MINUTES and this one's
+type DWELL_BUCKET struct {
+	MINUTES float64 `json:"MINUTES"`
+	WEIGHT  float64 `json:"WEIGHT"`
+}
+
+func (t TRAFFIC) enabled() bool {
+	return t.ARRIVALS_PER_HOUR > 0
+}
+
+func (t TRAFFIC) validate() error {
+	if len(t.HOURLY_PROFILE) != 0 && len(t.HOURLY_PROFILE) != 24 {
+		return fmt.Errorf("HOURLY_PROFILE needs 24 values, got %d", len(t.HOURLY_PROFILE))
+	}
+	if len(t.WEEKLY_PROFILE) != 0 && len(t.WEEKLY_PROFILE) != 7 {
+		return fmt.Errorf("WEEKLY_PROFILE needs 7 values, got %d", len(t.WEEKLY_PROFILE))
+	}
+	for _, value := range append(slices.Clone(t.HOURLY_PROFILE), t.WEEKLY_PROFILE...) {
+		if value < 0 {
+			return errors.New("profile values must not be negative")
+		}
+	}
+	if t.peakRate() <= 0 {
+		return errors.New("the arrival rate is zero at all times")
+	}
+
+	switch t.DWELL.DISTRIBUTION {
+	case "lognormal":
+		if t.DWELL.MEDIAN_MINUTES <= 0 || t.DWELL.SIGMA < 0 {
+			return errors.New("lognormal dwell needs a positive MEDIAN_MINUTES and a non-negative SIGMA")
+		}
+	case "histogram":
+		total := 0.0
+		previous := 0.0
+		for _, bucket := range t.DWELL.HISTOGRAM {
+			if bucket.MINUTES <= previous || bucket.WEIGHT < 0 {
+				return errors.New("histogram buckets need increasing MINUTES and non-negative weights")
+			}
+			previous = bucket.MINUTES
+			total += bucket.WEIGHT
+		}
+		if total <= 0 {
+			return errors.New("histogram dwell needs a bucket with a positive weight")
+		}
+	default:
+		return fmt.Errorf("unknown dwell distribution %q", t.DWELL.DISTRIBUTION)
+	}
+	return nil
+}
+
+// rate returns the arrival rate per hour at now
+func (t TRAFFIC) rate(now time.Time) float64 {
+	rate := t.ARRIVALS_PER_HOUR
+	if len(t.HOURLY_PROFILE) == 24 {
+		hour := now.Hour()
+		within := float64(now.Minute()*60+now.Second()) / 3600
+		rate *= t.HOURLY_PROFILE[hour]*(1-within) + t.HOURLY_PROFILE[(hour+1)%24]*within
+	}
+	if len(t.WEEKLY_PROFILE) == 7 {
+		rate *= t.WEEKLY_PROFILE[(int(now.Weekday())+6)%7]
+	}
+	return rate
+}
+
+// peakRate bounds rate at all times
+func (t TRAFFIC) peakRate() float64 {
+	rate := t.ARRIVALS_PER_HOUR
+	if len(t.HOURLY_PROFILE) == 24 {
+		rate *= slices.Max(t.HOURLY_PROFILE)
+	}
+	if len(t.WEEKLY_PROFILE) == 7 {
+		rate *= slices.Max(t.WEEKLY_PROFILE)
+	}
+	return rate
+}
+
+// nextArrival draws the arrival after from. Arrivals of the peak rate's homogeneous process are
+// kept with the probability of the rate at that time over the peak rate, which thins them into
+// a non-homogeneous Poisson process following the profiles.
+func (t TRAFFIC) nextArrival(from time.Time) time.Time {
+	peak := t.peakRate()
+	next := from
+	for {
+		hours := random.ExpFloat64() / peak
+		next = next.Add(time.Duration(hours * float64(time.Hour)))
+		if random.Float64()*peak < t.rate(next) {
+			return next
+		}
+	}
+}
+
+// dwell draws how long a car stays
+func (d DWELL) dwell() time.Duration {
+	minutes := 0.0
+	switch d.DISTRIBUTION {
+	case "lognormal":
+		minutes = d.MEDIAN_MINUTES * math.Exp(d.SIGMA*random.NormFloat64())
+	case "histogram":
+		total := 0.0
+		for _, bucket := range d.HISTOGRAM {
+			total += bucket.WEIGHT
+		}
+		pick := random.Float64() * total
+		previous := 0.0
+		for _, bucket := range d.HISTOGRAM {
+			if pick < bucket.WEIGHT {
+				minutes = previous + random.Float64()*(bucket.MINUTES-previous)
+				break
+			}
+			pick -= bucket.WEIGHT
+			previous = bucket.MINUTES
+		}
+	}
+	if d.MAX_MINUTES > 0 {
+		minutes = min(minutes, d.MAX_MINUTES)
+	}
+	return time.Duration(minutes * float64(time.Minute))
+}
+
+// How long a car waits at a paused exit toll before it tries again
+const exitRetryDelay = time.Minute
+
+// Car due to leave a garage at a scheduled time
+type departure struct {
+	at     time.Time
+	garage *garage
+	plate  string
+}
+
+// Departures ordered by time, a container/heap
+type departureQueue []departure
+
+func (q departureQueue) Len() int           { return len(q) }
+func (q departureQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+func (q departureQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *departureQueue) Push(x any)        { *q = append(*q, x.(departure)) }
+func (q *departureQueue) Pop() any {
+	old := *q
+	last := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return last
+}
+
+// Drives the tolls of all garages from the traffic profiles. Arrivals are turned away while their
+// garage is full, and every car that gets in leaves after its own dwell time. A single loop runs
+// every garage so that a seeded run stays reproducible.
+type trafficSimulator struct {
+	config  TRAFFIC
+	garages []*garage
+	noise   randomNoiser
+	mqtt    mqttWrapper
+	clock   *stepClock
+	// Simulated time the run starts at, the first arrivals are drawn from it
+	start time.Time
+
+	// Next arrival at each garage, by index into garages
+	nextArrivals []time.Time
+	departures   departureQueue
+}
+
+func (s *trafficSimulator) run() {
+	for {
+		s.step()
+	}
+}
+
+// trafficOf returns the profiles of a garage, with its own arrival rate if it has one
+func (s *trafficSimulator) trafficOf(garage *garage) TRAFFIC {
+	traffic := s.config
+	garage.mutex.Lock()
+	defer garage.mutex.Unlock()
+	if garage.config.ARRIVALS_PER_HOUR > 0 {
+		traffic.ARRIVALS_PER_HOUR = garage.config.ARRIVALS_PER_HOUR
+	}
+	return traffic
+}
+
+// step waits for the next arrival or departure at any garage, whichever comes first, and lets it
+// through. Events carry the time they were scheduled for rather than when the wait ended, so that
+// a seeded run reproduces them exactly.
+func (s *trafficSimulator) step() {
+	if s.nextArrivals == nil {
+		for _, garage := range s.garages {
+			s.nextArrivals = append(s.nextArrivals, s.trafficOf(garage).nextArrival(s.start))
+		}
+	}
+	arriving := 0
+	for i, at := range s.nextArrivals {
+		if at.Before(s.nextArrivals[arriving]) {
+			arriving = i
+		}
+	}
+	next := s.nextArrivals[arriving]
+	if len(s.departures) > 0 && s.departures[0].at.Before(next) {
+		s.clock.step(s.departures[0].at, s.depart)
+		return
+	}
+	s.clock.step(next, func() { s.arrive(arriving) })
+}
+
+// depart lets the first car of the departures out
+func (s *trafficSimulator) depart() {
+	leaving := heap.Pop(&s.departures).(departure)
+	garage := leaving.garage
+	garage.mutex.Lock()
+	defer garage.mutex.Unlock()
+	if garage.exitPaused {
+		// The car waits at the closed exit and tries again a minute later
+		leaving.at = leaving.at.Add(exitRetryDelay)
+		heap.Push(&s.departures, leaving)
+		return
+	}
+	if carIndex := slices.Index(garage.parkingLot, leaving.plate); carIndex >= 0 {
+		exitCar(garage, carIndex, s.mqtt, s.clock)
+	}
+}
+
+// arrive lets the car arriving at a garage in, unless the garage is full
+func (s *trafficSimulator) arrive(arriving int) {
+	garage := s.garages[arriving]
+	traffic := s.trafficOf(garage)
+	now := s.nextArrivals[arriving]
+	s.nextArrivals[arriving] = traffic.nextArrival(now)
+	garage.mutex.Lock()
+	defer garage.mutex.Unlock()
+	if garage.entryPaused {
+		return
+	}
+	if garage.full() {
+		log.Printf("Garage %s full, turning a car away", garage.config.ID)
+		return
+	}
+	plate := enterTollFunc(s.noise, garage, s.mqtt, s.clock)
+	heap.Push(&s.departures, departure{at: now.Add(traffic.DWELL.dwell()), garage: garage, plate: plate})
+}
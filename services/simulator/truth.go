@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"groundtruth"
+)
+
+// Ground truth of the run, kept in GROUND_TRUTH_PATH when set
+var truth = &truthLog{}
+
+// Writes truth records as NDJSON
+type truthLog struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func (l *truthLog) open(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out = file
+	return nil
+}
+
+// record logs the faults injected into an event and appends it to the ground truth
+func (l *truthLog) record(record groundtruth.Record) {
+	if len(record.Faults) > 0 {
+		log.Printf("fault: %s %s %s", record.Event, record.EventId, strings.Join(record.Faults, ","))
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.out == nil {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Println("Failed to marshal ground truth: ", err)
+		return
+	}
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		log.Println("Failed to write ground truth: ", err)
+	}
+}
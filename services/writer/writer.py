@@ -2,24 +2,112 @@ import http.server
 import socketserver
 import logging
 import os
-from prometheus_client import start_http_server, Summary
+import threading
+from collections import OrderedDict
+from opentelemetry import trace
+from opentelemetry.exporter.otlp.proto.http.trace_exporter import OTLPSpanExporter
+from opentelemetry.sdk.resources import Resource
+from opentelemetry.sdk.trace import TracerProvider
+from opentelemetry.sdk.trace.export import BatchSpanProcessor, ConsoleSpanExporter
+from opentelemetry.trace.propagation.tracecontext import TraceContextTextMapPropagator
+from prometheus_client import start_http_server, Histogram, Counter
 
 # Prometheus metrics
-REQUEST_LATENCY = Summary('request_latency_seconds', 'Latency of HTTP requests in seconds')
+REQUEST_LATENCY = Histogram('request_latency_seconds', 'Latency of HTTP requests in seconds')
+DUPLICATE_REQUESTS = Counter('duplicate_requests_total', 'Summaries dropped because their Idempotency-Key was already logged')
 
 LOG_FILE = "/logs/vehicle_summary.log"
+# Idempotency keys of the logged summaries, one per line, read back at startup
+KEYS_FILE = os.environ.get("IDEMPOTENCY_KEYS_FILE", "/logs/vehicle_summary.keys")
 PORT = int(os.environ.get("PORT", 8081))
+IDEMPOTENCY_CACHE_SIZE = int(os.environ.get("IDEMPOTENCY_CACHE_SIZE", 100000))
+# Where spans go like the backend's: none, otlp (OTEL_EXPORTER_OTLP_* variables) or stdout
+TRACES_EXPORTER = os.environ.get("TRACES_EXPORTER", "none")
+
+# Most recently logged idempotency keys, oldest first
+seen_keys = OrderedDict()
+seen_keys_lock = threading.Lock()
+
+
+def already_logged(key):
+    with seen_keys_lock:
+        return bool(key) and key in seen_keys
+
+
+def remember(key):
+    if not key:
+        return
+    with seen_keys_lock:
+        seen_keys[key] = True
+        if len(seen_keys) > IDEMPOTENCY_CACHE_SIZE:
+            seen_keys.popitem(last=False)
+
+
+def load_keys():
+    """Remembers the last IDEMPOTENCY_CACHE_SIZE keys of KEYS_FILE, so duplicates are still
+    dropped after a restart."""
+    try:
+        with open(KEYS_FILE) as keys_file:
+            content = keys_file.read()
+    except FileNotFoundError:
+        return
+    for key in content.splitlines():
+        remember(key.strip())
+    # A write cut short by a crash must not run into the next key
+    if content and not content.endswith("\n"):
+        with open(KEYS_FILE, "a") as keys_file:
+            keys_file.write("\n")
+    logging.info("Loaded %d idempotency keys from %s", len(seen_keys), KEYS_FILE)
+
+
+def setup_tracing():
+    """Installs the tracer provider picked by TRACES_EXPORTER, with none spans are not recorded."""
+    if TRACES_EXPORTER == "none":
+        return
+    if TRACES_EXPORTER == "otlp":
+        exporter = OTLPSpanExporter()
+    elif TRACES_EXPORTER == "stdout":
+        exporter = ConsoleSpanExporter()
+    else:
+        raise ValueError("unknown traces exporter " + TRACES_EXPORTER)
+    provider = TracerProvider(resource=Resource.create({"service.name": "writer"}))
+    provider.add_span_processor(BatchSpanProcessor(exporter))
+    trace.set_tracer_provider(provider)
+
+
+tracer = trace.get_tracer("parking-garage/writer")
+
 
 class SimpleHTTPRequestHandler(http.server.BaseHTTPRequestHandler):
     @REQUEST_LATENCY.time()
     def do_POST(self):
+        # Continues the backend's trace from its traceparent header
+        context = TraceContextTextMapPropagator().extract(self.headers)
+        with tracer.start_as_current_span("POST " + self.path, context=context, kind=trace.SpanKind.SERVER,
+                                          attributes={"http.request.method": "POST", "url.path": self.path}):
+            self.log_summary()
+
+    def log_summary(self):
         content_length = int(self.headers['Content-Length'])  # Get the size of data
         post_data = self.rfile.read(content_length)  # Read the data
         logging.info("Received POST request: %s", post_data.decode('utf-8'))
 
+        # The backend retries deliveries, answer duplicates without logging them again. Requests
+        # without an Idempotency-Key are not deduplicated and logged every time.
+        idempotency_key = self.headers.get('Idempotency-Key')
+        if already_logged(idempotency_key):
+            DUPLICATE_REQUESTS.inc()
+            self.send_response(200)
+            self.end_headers()
+            return
+
         # Log the POST
         with open(LOG_FILE, "a") as log_file:
             log_file.write(post_data.decode('utf-8') + "\n")
+        if idempotency_key:
+            with open(KEYS_FILE, "a") as keys_file:
+                keys_file.write(idempotency_key + "\n")
+        remember(idempotency_key)
 
         # Send response
         self.send_response(200)
@@ -27,6 +115,8 @@ class SimpleHTTPRequestHandler(http.server.BaseHTTPRequestHandler):
 
 if __name__ == "__main__":
     logging.basicConfig(level=logging.INFO)
+    setup_tracing()
+    load_keys()
     # Prometheus metrics server
     start_http_server(8001)
     with socketserver.TCPServer(("", PORT), SimpleHTTPRequestHandler) as httpd: